@@ -0,0 +1,128 @@
+package fsabstract
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// DescriptorStoreMap is the internal descriptor store mapping. As with
+	// FileStoreDriverMap, stores register themselves here when declared so
+	// that they can be loaded by name.
+	DescriptorStoreMap = map[string]func() DescriptorStore{}
+)
+
+// DescriptorStore is a catalog which persists FileStoreDescriptor objects,
+// so that callers can look up files by Id instead of keeping descriptors
+// themselves.
+type DescriptorStore interface {
+	StoreName() string
+	Configure(map[string]string)
+	Initialize() error
+	// Save creates or replaces the descriptor with the same Id.
+	Save(FileStoreDescriptor) error
+	// Load retrieves a descriptor by Id, returning ErrNotFound if it does
+	// not exist.
+	Load(int64) (FileStoreDescriptor, error)
+	// Delete removes a descriptor by Id. Deleting a descriptor which does
+	// not exist is not an error.
+	Delete(int64) error
+	// Query returns all descriptors matching a DescriptorQuery, ordered
+	// by Id.
+	Query(DescriptorQuery) ([]FileStoreDescriptor, error)
+	Close() error
+}
+
+// DescriptorUpdater is implemented by descriptor stores which are able to
+// perform a read-modify-write of a single descriptor atomically.
+type DescriptorUpdater interface {
+	Update(int64, func(FileStoreDescriptor) (FileStoreDescriptor, error)) error
+}
+
+// DescriptorSequencer is implemented by descriptor stores which can hand
+// out values from named, monotonically increasing sequences. It is used by
+// IGCatalog. SeedSequence raises a sequence so that the next value handed
+// out is above the given minimum; it never lowers it.
+type DescriptorSequencer interface {
+	NextSequence(string) (int64, error)
+	SeedSequence(string, int64) error
+}
+
+// DescriptorQuery describes the criteria used by DescriptorStore.Query.
+// Empty fields are ignored, so an empty DescriptorQuery matches everything.
+type DescriptorQuery struct {
+	// Name matches descriptors with exactly this name.
+	Name string
+	// Metadata matches descriptors which contain all of these key/value
+	// pairs.
+	Metadata map[string]string
+	// CreatedAfter matches descriptors created at or after this time.
+	CreatedAfter time.Time
+	// CreatedBefore matches descriptors created before this time.
+	CreatedBefore time.Time
+}
+
+// Matches determines whether a FileStoreDescriptor satisfies the query.
+func (self DescriptorQuery) Matches(d FileStoreDescriptor) bool {
+	if self.Name != "" && d.Name != self.Name {
+		return false
+	}
+	for k, v := range self.Metadata {
+		if mv, exists := d.Metadata[k]; !exists || mv != v {
+			return false
+		}
+	}
+	if !self.CreatedAfter.IsZero() && d.Created.Before(self.CreatedAfter) {
+		return false
+	}
+	if !self.CreatedBefore.IsZero() && !d.Created.Before(self.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// UpdateDescriptor applies fn to the stored descriptor with the given Id,
+// and saves the descriptor it returns. It is intended to wrap operations
+// which change the location list, such as Put, Migrate or Delete, ie:
+//
+//	UpdateDescriptor(s, id, func(d FileStoreDescriptor) (FileStoreDescriptor, error) {
+//		return Migrate(dFrom, dTo, d, locFrom, locTo)
+//	})
+//
+// Stores implementing DescriptorUpdater perform this atomically; for other
+// stores it is a plain Load followed by Save.
+func UpdateDescriptor(s DescriptorStore, id int64, fn func(FileStoreDescriptor) (FileStoreDescriptor, error)) error {
+	if u, ok := s.(DescriptorUpdater); ok {
+		return u.Update(id, fn)
+	}
+	d, err := s.Load(id)
+	if err != nil {
+		return err
+	}
+	dU, err := fn(d)
+	if err != nil {
+		return err
+	}
+	return s.Save(dU)
+}
+
+// SaveDescriptor saves a descriptor, or deletes it once it has no locations
+// left, as happens when all of its file data has been purged, so that the
+// catalog doesn't keep descriptors which refer to nothing.
+func SaveDescriptor(s DescriptorStore, d FileStoreDescriptor) error {
+	if len(d.Location) == 0 {
+		return s.Delete(d.Id)
+	}
+	return s.Save(d)
+}
+
+func GetDescriptorStore(storeName string) DescriptorStore {
+	s := strings.TrimSpace(storeName)
+	if _, exists := DescriptorStoreMap[s]; exists {
+		return DescriptorStoreMap[s]()
+	} else {
+		fmt.Println("Unable to resolve descriptor store " + s)
+		return nil
+	}
+}
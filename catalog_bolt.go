@@ -0,0 +1,189 @@
+package fsabstract
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"strconv"
+	"time"
+)
+
+var (
+	boltDescriptorBucket = []byte("descriptors")
+	boltSequenceBucket   = []byte("sequences")
+)
+
+func init() {
+	DescriptorStoreMap["bolt"] = func() DescriptorStore {
+		return new(DSBolt)
+	}
+}
+
+// DSBolt is an embedded on-disk descriptor store, backed by a single bbolt
+// database file. Descriptors are stored as JSON, keyed by Id.
+type DSBolt struct {
+	Path string `fsdconfig:"fs.catalog.bolt.path"`
+
+	db *bolt.DB
+}
+
+func (self *DSBolt) StoreName() string {
+	return "bolt"
+}
+
+func (self *DSBolt) Configure(c map[string]string) {
+	if v, exists := c["fs.catalog.bolt.path"]; exists {
+		self.Path = v
+	}
+}
+
+func (self *DSBolt) Initialize() error {
+	if self.Path == "" {
+		return errors.New("No path configured for bolt descriptor store")
+	}
+	db, err := bolt.Open(self.Path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltDescriptorBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(boltSequenceBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	self.db = db
+	return nil
+}
+
+func (self *DSBolt) Save(d FileStoreDescriptor) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return self.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDescriptorBucket).Put(boltKey(d.Id), b)
+	})
+}
+
+func (self *DSBolt) Load(id int64) (FileStoreDescriptor, error) {
+	var d FileStoreDescriptor
+	err := self.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltDescriptorBucket).Get(boltKey(id))
+		if b == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(b, &d)
+	})
+	return d, err
+}
+
+func (self *DSBolt) Delete(id int64) error {
+	return self.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDescriptorBucket).Delete(boltKey(id))
+	})
+}
+
+func (self *DSBolt) Query(q DescriptorQuery) ([]FileStoreDescriptor, error) {
+	r := make([]FileStoreDescriptor, 0)
+	err := self.db.View(func(tx *bolt.Tx) error {
+		// Keys sort by Id, so no further ordering is required
+		return tx.Bucket(boltDescriptorBucket).ForEach(func(k, v []byte) error {
+			var d FileStoreDescriptor
+			err := json.Unmarshal(v, &d)
+			if err != nil {
+				return err
+			}
+			if q.Matches(d) {
+				r = append(r, d)
+			}
+			return nil
+		})
+	})
+	return r, err
+}
+
+// Update atomically applies fn to the stored descriptor with the given Id,
+// saving the descriptor it returns. Both happen in one read-write
+// transaction, of which bbolt only runs one at a time. If fn returns an
+// error, nothing is saved.
+func (self *DSBolt) Update(id int64, fn func(FileStoreDescriptor) (FileStoreDescriptor, error)) error {
+	return self.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltDescriptorBucket)
+		b := bucket.Get(boltKey(id))
+		if b == nil {
+			return ErrNotFound
+		}
+		var d FileStoreDescriptor
+		err := json.Unmarshal(b, &d)
+		if err != nil {
+			return err
+		}
+		dU, err := fn(d)
+		if err != nil {
+			return err
+		}
+		if dU.Id != id {
+			return errors.New("Descriptor Id changed during update from " + strconv.FormatInt(id, 10))
+		}
+		b, err = json.Marshal(dU)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(boltKey(id), b)
+	})
+}
+
+// NextSequence uses the native sequence of a per-name bucket, nested in
+// the sequences bucket.
+func (self *DSBolt) NextSequence(name string) (int64, error) {
+	var n uint64
+	err := self.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(boltSequenceBucket).CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		n, err = b.NextSequence()
+		return err
+	})
+	return int64(n), err
+}
+
+func (self *DSBolt) SeedSequence(name string, min int64) error {
+	if min < 0 {
+		return nil
+	}
+	return self.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(boltSequenceBucket).CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		if b.Sequence() >= uint64(min) {
+			return nil
+		}
+		return b.SetSequence(uint64(min))
+	})
+}
+
+func (self *DSBolt) Close() error {
+	if self.db == nil {
+		return nil
+	}
+	err := self.db.Close()
+	self.db = nil
+	return err
+}
+
+// boltKey encodes an Id so that bbolt's byte ordering matches numeric
+// ordering, including for negative Ids.
+func boltKey(id int64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(id)^(1<<63))
+	return k
+}
@@ -0,0 +1,121 @@
+package fsabstract
+
+import (
+	"sort"
+	"sync"
+)
+
+func init() {
+	DescriptorStoreMap["memory"] = func() DescriptorStore {
+		return new(DSMemory)
+	}
+}
+
+// DSMemory is an in-memory descriptor store. Nothing is persisted, so it
+// should only be used for testing or ephemeral applications.
+type DSMemory struct {
+	descriptors map[int64]FileStoreDescriptor
+	sequences   map[string]int64
+	lock        sync.RWMutex
+}
+
+func (self *DSMemory) StoreName() string {
+	return "memory"
+}
+
+func (self *DSMemory) Configure(c map[string]string) {
+}
+
+func (self *DSMemory) Initialize() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.descriptors == nil {
+		self.descriptors = map[int64]FileStoreDescriptor{}
+	}
+	if self.sequences == nil {
+		self.sequences = map[string]int64{}
+	}
+	return nil
+}
+
+func (self *DSMemory) Save(d FileStoreDescriptor) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.descriptors[d.Id] = copyDescriptor(d)
+	return nil
+}
+
+func (self *DSMemory) Load(id int64) (FileStoreDescriptor, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	d, exists := self.descriptors[id]
+	if !exists {
+		return FileStoreDescriptor{}, ErrNotFound
+	}
+	return copyDescriptor(d), nil
+}
+
+func (self *DSMemory) Delete(id int64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.descriptors, id)
+	return nil
+}
+
+func (self *DSMemory) Query(q DescriptorQuery) ([]FileStoreDescriptor, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	r := make([]FileStoreDescriptor, 0)
+	for _, d := range self.descriptors {
+		if q.Matches(d) {
+			r = append(r, copyDescriptor(d))
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Id < r[j].Id })
+	return r, nil
+}
+
+func (self *DSMemory) NextSequence(name string) (int64, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.sequences[name]++
+	return self.sequences[name], nil
+}
+
+func (self *DSMemory) SeedSequence(name string, min int64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.sequences[name] < min {
+		self.sequences[name] = min
+	}
+	return nil
+}
+
+func (self *DSMemory) Close() error {
+	return nil
+}
+
+// copyDescriptor makes a copy of a FileStoreDescriptor which doesn't share
+// its Metadata map, Location slice or location Options with the original.
+func copyDescriptor(d FileStoreDescriptor) FileStoreDescriptor {
+	dU := d
+	if d.Metadata != nil {
+		dU.Metadata = make(map[string]string, len(d.Metadata))
+		for k, v := range d.Metadata {
+			dU.Metadata[k] = v
+		}
+	}
+	if d.Location != nil {
+		dU.Location = make([]FileStoreLocation, len(d.Location))
+		copy(dU.Location, d.Location)
+		for i, l := range dU.Location {
+			if l.Options != nil {
+				dU.Location[i].Options = make(map[string]string, len(l.Options))
+				for k, v := range l.Options {
+					dU.Location[i].Options[k] = v
+				}
+			}
+		}
+	}
+	return dU
+}
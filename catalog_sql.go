@@ -0,0 +1,550 @@
+package fsabstract
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	DescriptorStoreMap["sql"] = func() DescriptorStore {
+		return new(DSSQL)
+	}
+}
+
+// sqlMigrations is the ordered list of schema migrations applied by DSSQL.
+// Entries must never be changed once released; add a new entry instead.
+// Times are stored as unix nanoseconds, with zero meaning "unset", so that
+// the same schema works with PostgreSQL, MySQL and SQLite.
+var sqlMigrations = [][]string{
+	// 1: initial schema
+	{
+		`CREATE TABLE fs_descriptor (
+			id BIGINT NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			type VARCHAR(255) NOT NULL,
+			size BIGINT NOT NULL,
+			created BIGINT NOT NULL,
+			expires BIGINT NOT NULL
+		)`,
+		`CREATE INDEX fs_descriptor_name ON fs_descriptor (name)`,
+		`CREATE INDEX fs_descriptor_type ON fs_descriptor (type)`,
+		`CREATE INDEX fs_descriptor_created ON fs_descriptor (created)`,
+		`CREATE TABLE fs_location (
+			descriptor_id BIGINT NOT NULL,
+			seq INTEGER NOT NULL,
+			store_id VARCHAR(255) NOT NULL,
+			driver VARCHAR(64) NOT NULL,
+			location VARCHAR(1024) NOT NULL,
+			created BIGINT NOT NULL,
+			deleted BIGINT NOT NULL,
+			PRIMARY KEY (descriptor_id, seq)
+		)`,
+		`CREATE INDEX fs_location_driver ON fs_location (driver, store_id)`,
+		`CREATE TABLE fs_metadata (
+			descriptor_id BIGINT NOT NULL,
+			meta_key VARCHAR(255) NOT NULL,
+			meta_value TEXT NOT NULL,
+			PRIMARY KEY (descriptor_id, meta_key)
+		)`,
+		`CREATE INDEX fs_metadata_key ON fs_metadata (meta_key)`,
+	},
+	// 2: sequences
+	{
+		`CREATE TABLE fs_sequence (
+			name VARCHAR(255) NOT NULL PRIMARY KEY,
+			value BIGINT NOT NULL
+		)`,
+	},
+	// 3: location options
+	{
+		`CREATE TABLE fs_location_option (
+			descriptor_id BIGINT NOT NULL,
+			seq INTEGER NOT NULL,
+			opt_key VARCHAR(255) NOT NULL,
+			opt_value TEXT NOT NULL,
+			PRIMARY KEY (descriptor_id, seq, opt_key)
+		)`,
+	},
+}
+
+// DSSQL is a relational descriptor store built on database/sql. It works
+// with PostgreSQL, MySQL and SQLite; the database/sql driver for the
+// chosen database must be imported by the application. The schema is
+// created and migrated automatically by Initialize. With SQLite, concurrent
+// writers fail with "database is locked" unless the DSN sets a busy timeout
+// and immediate transactions, ie: catalog.db?_busy_timeout=5000&_txlock=immediate.
+type DSSQL struct {
+	DriverName string `fsdconfig:"fs.catalog.sql.driver"`
+	DSN        string `fsdconfig:"fs.catalog.sql.dsn"`
+
+	db *sql.DB
+}
+
+func (self *DSSQL) StoreName() string {
+	return "sql"
+}
+
+func (self *DSSQL) Configure(c map[string]string) {
+	if v, exists := c["fs.catalog.sql.driver"]; exists {
+		self.DriverName = v
+	}
+	if v, exists := c["fs.catalog.sql.dsn"]; exists {
+		self.DSN = v
+	}
+}
+
+func (self *DSSQL) Initialize() error {
+	db, err := sql.Open(self.DriverName, self.DSN)
+	if err != nil {
+		return err
+	}
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return err
+	}
+	self.db = db
+	err = self.migrate()
+	if err != nil {
+		db.Close()
+		self.db = nil
+		return err
+	}
+	return nil
+}
+
+func (self *DSSQL) Save(d FileStoreDescriptor) error {
+	tx, err := self.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = self.save(tx, d)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (self *DSSQL) Load(id int64) (FileStoreDescriptor, error) {
+	tx, err := self.db.Begin()
+	if err != nil {
+		return FileStoreDescriptor{}, err
+	}
+	defer tx.Rollback()
+	return self.load(tx, id, false)
+}
+
+func (self *DSSQL) Delete(id int64) error {
+	tx, err := self.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = self.delete(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (self *DSSQL) Query(q DescriptorQuery) ([]FileStoreDescriptor, error) {
+	where := make([]string, 0)
+	args := make([]interface{}, 0)
+	if q.Name != "" {
+		where = append(where, "d.name = ?")
+		args = append(args, q.Name)
+	}
+	// Sort keys, so that the generated statement is stable
+	keys := make([]string, 0, len(q.Metadata))
+	for k := range q.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		where = append(where, "EXISTS (SELECT 1 FROM fs_metadata m WHERE m.descriptor_id = d.id AND m.meta_key = ? AND m.meta_value = ?)")
+		args = append(args, k, q.Metadata[k])
+	}
+	if !q.CreatedAfter.IsZero() {
+		where = append(where, "d.created >= ?")
+		args = append(args, q.CreatedAfter.UnixNano())
+	}
+	if !q.CreatedBefore.IsZero() {
+		where = append(where, "d.created < ?")
+		args = append(args, q.CreatedBefore.UnixNano())
+	}
+	stmt := "SELECT d.id FROM fs_descriptor d"
+	if len(where) > 0 {
+		stmt += " WHERE " + strings.Join(where, " AND ")
+	}
+	stmt += " ORDER BY d.id"
+
+	tx, err := self.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(self.rebind(stmt), args...)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	r := make([]FileStoreDescriptor, 0, len(ids))
+	for _, id := range ids {
+		d, err := self.load(tx, id, false)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, d)
+	}
+	return r, nil
+}
+
+// Update atomically applies fn to the stored descriptor with the given Id,
+// saving the descriptor it returns. The descriptor row is locked for the
+// duration where the database supports it, so concurrent Put, Migrate or
+// Delete calls against the same file cannot lose location changes. If fn
+// returns an error, nothing is saved.
+func (self *DSSQL) Update(id int64, fn func(FileStoreDescriptor) (FileStoreDescriptor, error)) error {
+	tx, err := self.db.Begin()
+	if err != nil {
+		return err
+	}
+	d, err := self.load(tx, id, true)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	dU, err := fn(d)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if dU.Id != id {
+		tx.Rollback()
+		return errors.New("Descriptor Id changed during update from " + strconv.FormatInt(id, 10))
+	}
+	err = self.save(tx, dU)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// NextSequence increments a row in fs_sequence, creating it on first use.
+// The UPDATE takes a row lock, so concurrent callers are serialized.
+func (self *DSSQL) NextSequence(name string) (int64, error) {
+	var n int64
+	var err error
+	// Retry once, in case another caller created the row concurrently
+	for i := 0; i < 2; i++ {
+		n, err = self.nextSequence(name)
+		if err == nil {
+			return n, nil
+		}
+	}
+	return n, err
+}
+
+func (self *DSSQL) nextSequence(name string) (int64, error) {
+	tx, err := self.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(self.rebind("UPDATE fs_sequence SET value = value + 1 WHERE name = ?"), name)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if affected == 0 {
+		_, err = tx.Exec(self.rebind("INSERT INTO fs_sequence (name, value) VALUES (?, 1)"), name)
+		if err != nil {
+			return 0, err
+		}
+	}
+	var n int64
+	err = tx.QueryRow(self.rebind("SELECT value FROM fs_sequence WHERE name = ?"), name).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// SeedSequence only ever raises the stored value, so it is safe to race
+// with NextSequence.
+func (self *DSSQL) SeedSequence(name string, min int64) error {
+	var err error
+	// Retry once, in case another caller created the row concurrently
+	for i := 0; i < 2; i++ {
+		if err = self.seedSequence(name, min); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (self *DSSQL) seedSequence(name string, min int64) error {
+	tx, err := self.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(self.rebind("UPDATE fs_sequence SET value = ? WHERE name = ? AND value < ?"), min, name, min)
+	if err != nil {
+		return err
+	}
+	var n int64
+	err = tx.QueryRow(self.rebind("SELECT value FROM fs_sequence WHERE name = ?"), name).Scan(&n)
+	if err == sql.ErrNoRows {
+		_, err = tx.Exec(self.rebind("INSERT INTO fs_sequence (name, value) VALUES (?, ?)"), name, min)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (self *DSSQL) Close() error {
+	if self.db == nil {
+		return nil
+	}
+	err := self.db.Close()
+	self.db = nil
+	return err
+}
+
+// migrate brings the schema up to date, recording each applied migration
+// in fs_schema_version.
+func (self *DSSQL) migrate() error {
+	_, err := self.db.Exec("CREATE TABLE IF NOT EXISTS fs_schema_version (version INTEGER NOT NULL)")
+	if err != nil {
+		return err
+	}
+	var version sql.NullInt64
+	err = self.db.QueryRow("SELECT MAX(version) FROM fs_schema_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+	for i := int(version.Int64); i < len(sqlMigrations); i++ {
+		tx, err := self.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range sqlMigrations[i] {
+			_, err = tx.Exec(stmt)
+			if err != nil {
+				tx.Rollback()
+				return errors.New("Schema migration " + strconv.Itoa(i+1) + " failed : " + err.Error())
+			}
+		}
+		_, err = tx.Exec(self.rebind("INSERT INTO fs_schema_version (version) VALUES (?)"), i+1)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *DSSQL) save(tx *sql.Tx, d FileStoreDescriptor) error {
+	// Replace rather than upsert, since upsert syntax isn't portable
+	err := self.delete(tx, d.Id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(self.rebind("INSERT INTO fs_descriptor (id, name, type, size, created, expires) VALUES (?, ?, ?, ?, ?, ?)"),
+		d.Id, d.Name, d.Type, d.Size, sqlTime(d.Created), sqlTime(d.Expires))
+	if err != nil {
+		return err
+	}
+	for k, v := range d.Location {
+		_, err = tx.Exec(self.rebind("INSERT INTO fs_location (descriptor_id, seq, store_id, driver, location, created, deleted) VALUES (?, ?, ?, ?, ?, ?, ?)"),
+			d.Id, k, v.Id, v.Driver, v.Location, sqlTime(v.Created), sqlTime(v.Deleted))
+		if err != nil {
+			return err
+		}
+		for ok, ov := range v.Options {
+			_, err = tx.Exec(self.rebind("INSERT INTO fs_location_option (descriptor_id, seq, opt_key, opt_value) VALUES (?, ?, ?, ?)"),
+				d.Id, k, ok, ov)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for k, v := range d.Metadata {
+		_, err = tx.Exec(self.rebind("INSERT INTO fs_metadata (descriptor_id, meta_key, meta_value) VALUES (?, ?, ?)"),
+			d.Id, k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *DSSQL) load(tx *sql.Tx, id int64, lock bool) (FileStoreDescriptor, error) {
+	var d FileStoreDescriptor
+	var created, expires int64
+
+	stmt := "SELECT id, name, type, size, created, expires FROM fs_descriptor WHERE id = ?"
+	if lock && self.DriverName != "sqlite3" {
+		stmt += " FOR UPDATE"
+	}
+	err := tx.QueryRow(self.rebind(stmt), id).Scan(&d.Id, &d.Name, &d.Type, &d.Size, &created, &expires)
+	if err == sql.ErrNoRows {
+		return d, ErrNotFound
+	}
+	if err != nil {
+		return d, err
+	}
+	d.Created = fromSqlTime(created)
+	d.Expires = fromSqlTime(expires)
+
+	rows, err := tx.Query(self.rebind("SELECT store_id, driver, location, created, deleted FROM fs_location WHERE descriptor_id = ? ORDER BY seq"), id)
+	if err != nil {
+		return d, err
+	}
+	for rows.Next() {
+		var l FileStoreLocation
+		var lcreated, ldeleted int64
+		err = rows.Scan(&l.Id, &l.Driver, &l.Location, &lcreated, &ldeleted)
+		if err != nil {
+			rows.Close()
+			return d, err
+		}
+		l.Created = fromSqlTime(lcreated)
+		l.Deleted = fromSqlTime(ldeleted)
+		if d.Location == nil {
+			d.Location = make([]FileStoreLocation, 0)
+		}
+		d.Location = append(d.Location, l)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return d, err
+	}
+
+	rows, err = tx.Query(self.rebind("SELECT seq, opt_key, opt_value FROM fs_location_option WHERE descriptor_id = ?"), id)
+	if err != nil {
+		return d, err
+	}
+	for rows.Next() {
+		var seq int
+		var k, v string
+		err = rows.Scan(&seq, &k, &v)
+		if err != nil {
+			rows.Close()
+			return d, err
+		}
+		if seq < 0 || seq >= len(d.Location) {
+			continue
+		}
+		if d.Location[seq].Options == nil {
+			d.Location[seq].Options = map[string]string{}
+		}
+		d.Location[seq].Options[k] = v
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return d, err
+	}
+
+	rows, err = tx.Query(self.rebind("SELECT meta_key, meta_value FROM fs_metadata WHERE descriptor_id = ?"), id)
+	if err != nil {
+		return d, err
+	}
+	for rows.Next() {
+		var k, v string
+		err = rows.Scan(&k, &v)
+		if err != nil {
+			rows.Close()
+			return d, err
+		}
+		if d.Metadata == nil {
+			d.Metadata = map[string]string{}
+		}
+		d.Metadata[k] = v
+	}
+	rows.Close()
+	return d, rows.Err()
+}
+
+func (self *DSSQL) delete(tx *sql.Tx, id int64) error {
+	for _, stmt := range []string{
+		"DELETE FROM fs_metadata WHERE descriptor_id = ?",
+		"DELETE FROM fs_location_option WHERE descriptor_id = ?",
+		"DELETE FROM fs_location WHERE descriptor_id = ?",
+		"DELETE FROM fs_descriptor WHERE id = ?",
+	} {
+		_, err := tx.Exec(self.rebind(stmt), id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebind converts "?" placeholders to the "$n" style used by PostgreSQL
+// drivers.
+func (self *DSSQL) rebind(stmt string) string {
+	if self.DriverName != "postgres" && self.DriverName != "pgx" {
+		return stmt
+	}
+	out := make([]byte, 0, len(stmt)+8)
+	n := 0
+	for i := 0; i < len(stmt); i++ {
+		if stmt[i] == '?' {
+			n++
+			out = append(out, '$')
+			out = strconv.AppendInt(out, int64(n), 10)
+			continue
+		}
+		out = append(out, stmt[i])
+	}
+	return string(out)
+}
+
+// sqlTime converts a time to unix nanoseconds, keeping the zero time as 0.
+func sqlTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromSqlTime reverses sqlTime.
+func fromSqlTime(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
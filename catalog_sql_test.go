@@ -0,0 +1,40 @@
+package fsabstract
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLDescriptorStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsabstract-sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := map[string]string{
+		"fs.catalog.sql.driver": "sqlite3",
+		"fs.catalog.sql.dsn":    filepath.Join(dir, "catalog.db") + "?_busy_timeout=5000&_txlock=immediate",
+	}
+	testDescriptorStore(t, "sql", c)
+
+	// Reopening an existing database must not reapply migrations
+	t.Log("Reopen")
+	s := GetDescriptorStore("sql")
+	s.Configure(c)
+	err = s.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	r, err := s.Query(DescriptorQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 2 {
+		t.Errorf("Found %d descriptors after reopen, expected 2", len(r))
+	}
+}
@@ -0,0 +1,195 @@
+package fsabstract
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryDescriptorStore(t *testing.T) {
+	testDescriptorStore(t, "memory", map[string]string{})
+}
+
+func TestBoltDescriptorStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsabstract-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testDescriptorStore(t, "bolt", map[string]string{
+		"fs.catalog.bolt.path": filepath.Join(dir, "catalog.db"),
+	})
+}
+
+// testDescriptorStore exercises the DescriptorStore contract against a
+// named store implementation.
+func testDescriptorStore(t *testing.T, name string, c map[string]string) {
+	t.Log("Testing " + name + " descriptor store")
+
+	s := GetDescriptorStore(name)
+	if s == nil {
+		t.Fatal("Unable to instantiate " + name + " descriptor store")
+	}
+	s.Configure(c)
+	err := s.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	base := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	fixtures := []FileStoreDescriptor{
+		{
+			Id:       3,
+			Name:     "c.txt",
+			Created:  base.Add(2 * time.Hour),
+			Metadata: map[string]string{"owner": "alice"},
+			Location: []FileStoreLocation{{Driver: "dummy", Location: "file_3", Options: map[string]string{"class": "cold"}}},
+		},
+		{
+			Id:       1,
+			Name:     "a.txt",
+			Created:  base,
+			Metadata: map[string]string{"owner": "alice", "kind": "report"},
+		},
+		{
+			Id:      2,
+			Name:    "b.txt",
+			Created: base.Add(time.Hour),
+		},
+	}
+	for _, d := range fixtures {
+		err = s.Save(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Log("Load()")
+	d, err := s.Load(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != "c.txt" || len(d.Location) != 1 || d.Location[0].Location != "file_3" || d.Location[0].Options["class"] != "cold" {
+		t.Error("Unexpected descriptor loaded : " + d.ToString())
+	}
+	_, err = s.Load(42)
+	if err != ErrNotFound {
+		t.Errorf("Load() of missing descriptor returned %v, expected ErrNotFound", err)
+	}
+
+	t.Log("Query()")
+	queries := []struct {
+		q   DescriptorQuery
+		ids []int64
+	}{
+		{DescriptorQuery{}, []int64{1, 2, 3}},
+		{DescriptorQuery{Name: "b.txt"}, []int64{2}},
+		{DescriptorQuery{Metadata: map[string]string{"owner": "alice"}}, []int64{1, 3}},
+		{DescriptorQuery{Metadata: map[string]string{"owner": "alice", "kind": "report"}}, []int64{1}},
+		{DescriptorQuery{CreatedAfter: base.Add(time.Hour)}, []int64{2, 3}},
+		{DescriptorQuery{CreatedBefore: base.Add(time.Hour)}, []int64{1}},
+	}
+	for _, v := range queries {
+		r, err := s.Query(v.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]int64, 0)
+		for _, d := range r {
+			ids = append(ids, d.Id)
+		}
+		if len(ids) != len(v.ids) {
+			t.Errorf("Query(%v) returned %v, expected %v", v.q, ids, v.ids)
+			continue
+		}
+		for k := range ids {
+			if ids[k] != v.ids[k] {
+				t.Errorf("Query(%v) returned %v, expected %v", v.q, ids, v.ids)
+				break
+			}
+		}
+	}
+
+	t.Log("UpdateDescriptor()")
+	err = UpdateDescriptor(s, 2, func(d FileStoreDescriptor) (FileStoreDescriptor, error) {
+		d.Location = append(d.Location, FileStoreLocation{Driver: "dummy", Location: "file_2"})
+		return d, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err = s.Load(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Location) != 1 || d.Location[0].Location != "file_2" {
+		t.Error("Update not persisted : " + d.ToString())
+	}
+
+	if _, ok := s.(DescriptorUpdater); ok {
+		// Concurrent updates don't lose each other's changes
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				err := UpdateDescriptor(s, 2, func(d FileStoreDescriptor) (FileStoreDescriptor, error) {
+					return AddLocation(d, FileStoreLocation{Driver: "dummy", Location: "copy_" + strconv.Itoa(i)}), nil
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		if d, err = s.Load(2); err != nil || len(d.Location) != 11 {
+			t.Errorf("Concurrent updates left %d locations, %v", len(d.Location), err)
+		}
+		if err = UpdateDescriptor(s, 42, func(d FileStoreDescriptor) (FileStoreDescriptor, error) { return d, nil }); err != ErrNotFound {
+			t.Errorf("Update of missing descriptor returned %v, expected ErrNotFound", err)
+		}
+	}
+
+	t.Log("NextSequence()")
+	if seq, ok := s.(DescriptorSequencer); ok {
+		for i := int64(1); i <= 3; i++ {
+			n, err := seq.NextSequence("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != i {
+				t.Errorf("NextSequence() returned %d, expected %d", n, i)
+			}
+		}
+		t.Log("SeedSequence()")
+		for _, seed := range []int64{10, 5} {
+			if err = seq.SeedSequence("test", seed); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = seq.SeedSequence("seeded", 7); err != nil {
+			t.Fatal(err)
+		}
+		for name, expected := range map[string]int64{"test": 11, "seeded": 8} {
+			if n, err := seq.NextSequence(name); err != nil || n != expected {
+				t.Errorf("NextSequence(%s) after seeding returned %d, %v", name, n, err)
+			}
+		}
+	}
+
+	t.Log("Delete()")
+	err = s.Delete(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Load(3)
+	if err != ErrNotFound {
+		t.Errorf("Load() after Delete() returned %v, expected ErrNotFound", err)
+	}
+}
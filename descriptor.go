@@ -18,6 +18,11 @@ type FileStoreDescriptor struct {
 	// Created represents the time that this FileStoreDescriptor resource
 	// was initially created/stored.
 	Created time.Time `json:"created"`
+	// Expires represents the time after which this FileStoreDescriptor
+	// resource should no longer be available. A zero value means that the
+	// resource never expires. Drivers use native expiry where the backend
+	// supports it, but treat an expired resource as not found regardless.
+	Expires time.Time `json:"expires"`
 	// Metadata describes arbitrary metadata. This is undefined by the
 	// specification, and can be used by applications to store additional
 	// key/value pairs in file storage.
@@ -37,6 +42,12 @@ func (self *FileStoreDescriptor) ToString() string {
 	return string(b)
 }
 
+// Expired determines whether this FileStoreDescriptor has an expiry time
+// which has already passed.
+func (self *FileStoreDescriptor) Expired() bool {
+	return !self.Expires.IsZero() && !self.Expires.After(time.Now())
+}
+
 type FileStoreLocation struct {
 	// Id represents the identification of the store in which this
 	// driver has stored the instance of the file. For example, for an
@@ -52,6 +63,26 @@ type FileStoreLocation struct {
 	// Created represents the time this FileStoreLocation object was
 	// created/stored by the driver.
 	Created time.Time `json:"storeCreated"`
+	// Deleted represents the time this FileStoreLocation was soft deleted,
+	// and is zero for live locations. Soft deleted locations are retained
+	// so that they can be undeleted until they are purged.
+	Deleted time.Time `json:"storeDeleted"`
+	// Options records driver-specific options chosen when the file data
+	// was stored, such as the S3 storage class or encryption mode.
+	Options map[string]string `json:"storeOptions,omitempty"`
+}
+
+// IsDeleted determines whether this FileStoreLocation has been soft deleted.
+func (self *FileStoreLocation) IsDeleted() bool {
+	return !self.Deleted.IsZero()
+}
+
+// Key identifies the instance of file data described by this
+// FileStoreLocation, by its driver, store and location. Unlike the struct
+// itself, it doesn't depend on timestamps or options, which change as the
+// location is soft deleted or passes through serialization.
+func (self *FileStoreLocation) Key() string {
+	return self.Driver + ":" + self.Id + ":" + self.Location
 }
 
 // ToString handles JSON serialization transparently.
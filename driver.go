@@ -2,7 +2,10 @@ package fsabstract
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"strings"
+	"time"
 )
 
 var (
@@ -21,6 +24,93 @@ type FileStoreDriver interface {
 	Delete(FileStoreDescriptor, FileStoreLocation) (FileStoreDescriptor, error)
 }
 
+// FileStoreTrasher is implemented by drivers which are able to move file
+// data into a trash namespace instead of destroying it immediately. It is
+// used by FSSoftDelete.
+type FileStoreTrasher interface {
+	// Trash moves the file data at a location into the trash namespace,
+	// returning the location of the trashed data.
+	Trash(FileStoreLocation) (FileStoreLocation, error)
+	// Restore moves trashed file data back out of the trash namespace,
+	// returning the restored location.
+	Restore(FileStoreLocation) (FileStoreLocation, error)
+	// Purge permanently removes trashed file data.
+	Purge(FileStoreLocation) error
+}
+
+// FileStoreStreamer is implemented by drivers which are able to store file
+// data from a reader, without holding all of it in memory.
+type FileStoreStreamer interface {
+	// PutReader stores the file data read from r until EOF, as Put does,
+	// and sets Size to the number of bytes stored.
+	PutReader(FileStoreDescriptor, io.Reader) (FileStoreDescriptor, error)
+}
+
+// PutReader stores file data read from r with a driver, streaming it if
+// the driver implements FileStoreStreamer and reading it into memory for
+// Put otherwise. Size is set to the number of bytes stored.
+func PutReader(driver FileStoreDriver, d FileStoreDescriptor, r io.Reader) (FileStoreDescriptor, error) {
+	if s, ok := driver.(FileStoreStreamer); ok {
+		return s.PutReader(d, r)
+	}
+	c, err := ioutil.ReadAll(r)
+	if err != nil {
+		return d, err
+	}
+	d.Size = int64(len(c))
+	return driver.Put(d, c)
+}
+
+// FileStoreLocationGetter is implemented by drivers which are able to read
+// file data from a specific location, for descriptors with several
+// locations for the same driver.
+type FileStoreLocationGetter interface {
+	// GetFrom retrieves the file data at a location of a descriptor.
+	GetFrom(FileStoreDescriptor, FileStoreLocation) ([]byte, error)
+}
+
+// GetFrom retrieves the file data at a specific location of a descriptor
+// with a driver. Drivers which don't implement FileStoreLocationGetter are
+// handed a copy of the descriptor holding only that location.
+func GetFrom(driver FileStoreDriver, d FileStoreDescriptor, l FileStoreLocation) ([]byte, error) {
+	if g, ok := driver.(FileStoreLocationGetter); ok {
+		return g.GetFrom(d, l)
+	}
+	d.Location = []FileStoreLocation{l}
+	c, _, err := driver.Get(d)
+	return c, err
+}
+
+// FileStoreStorePutter is implemented by drivers which serve several
+// stores, such as buckets, and are able to store file data in a chosen one.
+type FileStoreStorePutter interface {
+	// PutTo stores file data as Put does, in the store with the given id,
+	// as recorded in FileStoreLocation.Id.
+	PutTo(FileStoreDescriptor, string, []byte) (FileStoreDescriptor, error)
+}
+
+// FileStoreRecoverer is implemented by drivers which store enough of each
+// FileStoreDescriptor alongside the file data to rebuild a lost catalog.
+type FileStoreRecoverer interface {
+	// Recover returns the descriptors of every file held by the driver,
+	// ordered by Id, each with the location at which the driver holds it.
+	Recover() ([]FileStoreDescriptor, error)
+}
+
+// URLSigner is implemented by drivers which are able to hand out
+// time-limited URLs, so that clients can fetch or store file data without
+// it passing through this process.
+type URLSigner interface {
+	// Locate returns the location at which the file data for a descriptor
+	// would be stored, without storing anything, so that a PUT URL can be
+	// signed for it.
+	Locate(FileStoreDescriptor) (FileStoreLocation, error)
+	// SignURL returns a URL through which the file data at a location can
+	// be fetched (http.MethodGet) or stored (http.MethodPut) until ttl has
+	// passed.
+	SignURL(l FileStoreLocation, method string, ttl time.Duration) (string, error)
+}
+
 func GetDriver(driverName string) FileStoreDriver {
 	d := strings.TrimSpace(driverName)
 	if _, exists := FileStoreDriverMap[d]; exists {
@@ -1,12 +1,39 @@
 package fsabstract
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
 	"io/ioutil"
+	"log"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	// dummyTrashDir is the subdirectory of the basepath which holds
+	// trashed files.
+	dummyTrashDir = ".trash"
+	// dummyExpiresSuffix is appended to the path of a file to name the
+	// marker file holding its expiry time.
+	dummyExpiresSuffix = ".expires"
+	// DefaultFileMode and DefaultDirMode are the permissions given to files
+	// and directories created by local filesystem drivers.
+	DefaultFileMode os.FileMode = 0600
+	DefaultDirMode  os.FileMode = 0700
+	// dummyMaxShardDepth limits the number of directory levels files are
+	// spread across.
+	dummyMaxShardDepth = 8
+)
+
 func init() {
 	FileStoreDriverMap["dummy"] = func() FileStoreDriver {
 		return new(FSDummy)
@@ -16,8 +43,50 @@ func init() {
 // FSDummy is a simple filesystem driver, set by a basepath, in which all
 // files are stored in a single directory. It doesn't scale, and should only
 // be used for testing or limited applications.
+//
+// Setting ShardDepth spreads files across that many levels of
+// subdirectories, named by successive bytes of a hash of the file name (and
+// so of the Id), ie: basepath/ab/cd/file_<hex> for a depth of 2. Files
+// stored under a different layout are still found by Get, and Reshard
+// moves existing files into the configured layout.
+//
+// Files are written atomically, through a temporary file which is synced
+// and renamed into place, so a crash never leaves a partial file behind.
+// They are created with FileMode, and directories with DirMode, both given
+// in octal.
+//
+// Locations are recorded relative to BasePath, and any location which
+// resolves to a path outside of it, directly or through a symlink, is
+// refused with ErrInvalidLocation. Setting LegacyLocations also accepts the
+// BasePath-prefixed and absolute locations recorded by older versions, as
+// long as they are inside BasePath.
+//
+// Setting Metadata to "sidecar" records the descriptor of each file as
+// JSON in a file_<hex>.json file beside it, and "xattr" records it in an
+// extended attribute (on Linux only), so that the directory describes
+// itself and Recover can rebuild the descriptors after a catalog is lost.
+//
+// Expiring files are tracked with a marker file beside the file data, and
+// are removed by a background sweeper if SweepInterval is set.
+//
+// If URLBase and URLKey are set, SignURL hands out URLs under URLBase (the
+// address of fsdaemon) which carry an HMAC-SHA256 signature made with
+// URLKey. The server checks them with VerifyURL.
 type FSDummy struct {
-	BasePath string `fsdconfig:"fs.dummy.basepath"`
+	BasePath      string        `fsdconfig:"fs.dummy.basepath"`
+	SweepInterval time.Duration `fsdconfig:"fs.dummy.sweepInterval"`
+	ShardDepth    int           `fsdconfig:"fs.dummy.shardDepth"`
+	FileMode      os.FileMode   `fsdconfig:"fs.dummy.fileMode"`
+	DirMode       os.FileMode   `fsdconfig:"fs.dummy.dirMode"`
+	URLBase       string        `fsdconfig:"fs.dummy.urlBase"`
+	URLKey        string        `fsdconfig:"fs.dummy.urlKey"`
+
+	LegacyLocations bool   `fsdconfig:"fs.dummy.legacyLocations"`
+	Metadata        string `fsdconfig:"fs.dummy.metadata"`
+
+	root      string // absolute BasePath
+	realRoot  string // root with symlinks resolved
+	stopSweep chan bool
 }
 
 func (self *FSDummy) DriverName() string {
@@ -28,10 +97,86 @@ func (self *FSDummy) Configure(c map[string]string) {
 	if v, exists := c["fs.dummy.basepath"]; exists {
 		self.BasePath = v
 	}
+	if v, exists := c["fs.dummy.sweepInterval"]; exists {
+		i, err := time.ParseDuration(v)
+		if err != nil {
+			panic("Unable to parse sweep interval " + v)
+		}
+		self.SweepInterval = i
+	}
+	if v, exists := c["fs.dummy.shardDepth"]; exists {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > dummyMaxShardDepth {
+			panic("Unable to use shard depth " + v)
+		}
+		self.ShardDepth = n
+	}
+	if v, exists := c["fs.dummy.fileMode"]; exists {
+		self.FileMode = parseFileMode(v)
+	}
+	if v, exists := c["fs.dummy.dirMode"]; exists {
+		self.DirMode = parseFileMode(v)
+	}
+	if v, exists := c["fs.dummy.urlBase"]; exists {
+		self.URLBase = strings.TrimSuffix(v, "/")
+	}
+	if v, exists := c["fs.dummy.urlKey"]; exists {
+		self.URLKey = v
+	}
+	if v, exists := c["fs.dummy.legacyLocations"]; exists {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			panic("Unable to parse legacy locations flag " + v)
+		}
+		self.LegacyLocations = b
+	}
+	if v, exists := c["fs.dummy.metadata"]; exists {
+		switch v {
+		case DUMMY_METADATA_NONE, DUMMY_METADATA_SIDECAR:
+		case DUMMY_METADATA_XATTR:
+			if !xattrSupported {
+				panic("Extended attributes are not supported on this platform")
+			}
+		default:
+			panic("Unknown metadata mode " + v)
+		}
+		self.Metadata = v
+	}
 }
 
 func (self *FSDummy) Initialize() error {
-	return os.MkdirAll(self.BasePath, 0700)
+	if self.FileMode == 0 {
+		self.FileMode = DefaultFileMode
+	}
+	if self.DirMode == 0 {
+		self.DirMode = DefaultDirMode
+	}
+	err := os.MkdirAll(self.BasePath, self.DirMode)
+	if err != nil {
+		return err
+	}
+	self.root, err = filepath.Abs(self.BasePath)
+	if err != nil {
+		return err
+	}
+	self.realRoot, err = filepath.EvalSymlinks(self.root)
+	if err != nil {
+		return err
+	}
+	if self.SweepInterval > 0 && self.stopSweep == nil {
+		self.stopSweep = make(chan bool)
+		go self.sweeper(self.stopSweep)
+	}
+	return nil
+}
+
+// Close stops the background sweeper, if it is running.
+func (self *FSDummy) Close() error {
+	if self.stopSweep != nil {
+		close(self.stopSweep)
+		self.stopSweep = nil
+	}
+	return nil
 }
 
 func (self *FSDummy) Get(d FileStoreDescriptor) ([]byte, FileStoreLocation, error) {
@@ -40,16 +185,32 @@ func (self *FSDummy) Get(d FileStoreDescriptor) ([]byte, FileStoreLocation, erro
 	if err != nil {
 		return nil, FileStoreLocation{}, err
 	}
+	c, err := self.GetFrom(d, l)
+	return c, l, err
+}
+
+// GetFrom retrieves the file data at a specific location of a descriptor.
+func (self *FSDummy) GetFrom(d FileStoreDescriptor, l FileStoreLocation) ([]byte, error) {
+	err := checkLocation(l, self.DriverName())
+	if err != nil {
+		return nil, err
+	}
+	if d.Expired() {
+		return nil, ErrNotFound
+	}
 
 	// Retrieve actual file data from disk
-	fullPath := /* self.BasePath + string(os.PathSeparator) + */ l.Location
+	fullPath, err := self.resolve(l.Location)
+	if err != nil {
+		return nil, err
+	}
 	c, err := ioutil.ReadFile(fullPath)
 	if err != nil {
-		return nil, l, err
+		return nil, err
 	}
 
 	// Send everything back
-	return c, l, nil
+	return c, nil
 }
 
 func (self *FSDummy) Put(d FileStoreDescriptor, c []byte) (FileStoreDescriptor, error) {
@@ -57,48 +218,313 @@ func (self *FSDummy) Put(d FileStoreDescriptor, c []byte) (FileStoreDescriptor,
 	dU := d
 
 	// Create new location
-	fullPath := self.BasePath + string(os.PathSeparator) + "file_" + strconv.FormatInt(dU.Id, 16) // hex
-	l := FileStoreLocation{
-		Id:       "", // dummy driver doesn't have a store name/id
-		Driver:   self.DriverName(),
-		Created:  time.Now(),
-		Location: fullPath,
-	}
+	l, _ := self.Locate(dU)
 
 	// Push out to filesystem
-	err := ioutil.WriteFile(l.Location, c, 0777)
+	_, err := self.write(self.fullPath(l.Location), dU, bytes.NewReader(c))
 	if err != nil {
 		return dU, err
 	}
 
 	// Append location
-	if dU.Location == nil {
-		dU.Location = make([]FileStoreLocation, 0)
-	}
-	dU.Location = append(d.Location, l)
+	dU = AddLocation(dU, l)
 
 	// No errors, send back
 	return dU, nil
 }
 
+// Locate returns the location at which Put stores the file data for a
+// descriptor.
+func (self *FSDummy) Locate(d FileStoreDescriptor) (FileStoreLocation, error) {
+	return FileStoreLocation{
+		Id:       "", // dummy driver doesn't have a store name/id
+		Driver:   self.DriverName(),
+		Created:  time.Now(),
+		Location: self.filePath("file_" + strconv.FormatInt(d.Id, 16)), // hex
+	}, nil
+}
+
+// SignURL returns a URL under URLBase for fetching or storing the file data
+// at a location, signed with URLKey.
+func (self *FSDummy) SignURL(l FileStoreLocation, method string, ttl time.Duration) (string, error) {
+	if self.URLBase == "" || self.URLKey == "" {
+		return "", errors.New("No URL base or key configured for signed URLs")
+	}
+	if method != "GET" && method != "PUT" {
+		return "", errors.New("Unable to sign URL for " + method)
+	}
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	q := url.Values{}
+	q.Set("location", l.Location)
+	q.Set("expires", expires)
+	q.Set("signature", hex.EncodeToString(self.signature(method, l.Location, expires)))
+	return self.URLBase + "/signed?" + q.Encode(), nil
+}
+
+// VerifyURL checks the query of a request to a URL made by SignURL,
+// returning the location it grants access to.
+func (self *FSDummy) VerifyURL(method string, q url.Values) (FileStoreLocation, error) {
+	if self.URLKey == "" {
+		return FileStoreLocation{}, errors.New("No URL key configured for signed URLs")
+	}
+	loc, expires := q.Get("location"), q.Get("expires")
+	sig, err := hex.DecodeString(q.Get("signature"))
+	if err != nil || !hmac.Equal(sig, self.signature(method, loc, expires)) {
+		return FileStoreLocation{}, errors.New("Invalid URL signature")
+	}
+	e, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > e {
+		return FileStoreLocation{}, errors.New("Signed URL expired")
+	}
+	return FileStoreLocation{Driver: self.DriverName(), Location: loc}, nil
+}
+
+// WriteLocation stores file data for a descriptor read from r at a
+// location, with its expiry marker and metadata as Put does, returning the
+// descriptor with Size set. It serves PUT requests to signed URLs.
+func (self *FSDummy) WriteLocation(d FileStoreDescriptor, l FileStoreLocation, r io.Reader) (FileStoreDescriptor, error) {
+	fullPath, err := self.resolve(l.Location)
+	if err != nil {
+		return d, err
+	}
+	n, err := self.write(fullPath, d, r)
+	if err != nil {
+		return d, err
+	}
+	d.Size = n
+	return d, nil
+}
+
+// LocationId returns the Id of the descriptor whose file data Locate puts
+// at a location, so that the descriptor behind a signed URL can be found.
+func (self *FSDummy) LocationId(l FileStoreLocation) (int64, error) {
+	base := path.Base(l.Location)
+	id, err := strconv.ParseInt(strings.TrimPrefix(base, "file_"), 16, 64)
+	if err != nil || !strings.HasPrefix(base, "file_") {
+		return 0, ErrInvalidLocation
+	}
+	if v, _ := self.Locate(FileStoreDescriptor{Id: id}); v.Location != l.Location {
+		return 0, ErrInvalidLocation
+	}
+	return id, nil
+}
+
+// write stores file data, followed by the expiry marker, if the descriptor
+// expires, and the metadata. A marker left by a previous version is
+// removed.
+func (self *FSDummy) write(fullPath string, d FileStoreDescriptor, r io.Reader) (int64, error) {
+	n, err := writeFileAtomic(fullPath, r, self.FileMode, self.DirMode, nil)
+	if err != nil {
+		return n, err
+	}
+	if !d.Expires.IsZero() {
+		_, err = writeFileAtomic(fullPath+dummyExpiresSuffix, strings.NewReader(d.Expires.Format(time.RFC3339)), self.FileMode, self.DirMode, nil)
+	} else if err = os.Remove(fullPath + dummyExpiresSuffix); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, self.writeMetadata(fullPath, d, n)
+}
+
+// signature returns the HMAC of a method, location and expiry time.
+func (self *FSDummy) signature(method, location, expires string) []byte {
+	h := hmac.New(sha256.New, []byte(self.URLKey))
+	h.Write([]byte(method + "\n" + location + "\n" + expires))
+	return h.Sum(nil)
+}
+
 func (self *FSDummy) Delete(d FileStoreDescriptor, l FileStoreLocation) (FileStoreDescriptor, error) {
 	dU := d
 
-	// Find the pertinent FileStoreLocation
-	l, err := LocationForDriver(d, self.DriverName())
+	// Find the pertinent FileStoreLocation, if we weren't given one
+	l, err := driverLocation(dU, l, self.DriverName())
 	if err != nil {
 		return dU, err
 	}
 
 	// Delete from disk
-	err = os.Remove(l.Location)
+	fullPath, err := self.resolve(l.Location)
 	if err != nil {
 		return dU, err
 	}
+	err = os.Remove(fullPath)
+	if err != nil {
+		return dU, err
+	}
+	for _, v := range dummySidecars {
+		os.Remove(fullPath + v)
+	}
 
 	// Remove from mapping
-	RemoveLocation(dU, l)
+	dU = RemoveLocation(dU, l)
 
 	// No errors, send back
 	return dU, nil
 }
+
+func (self *FSDummy) Trash(l FileStoreLocation) (FileStoreLocation, error) {
+	lU := l
+	lU.Location = dummyTrashDir + "/" + filepath.Base(l.Location)
+
+	from, err := self.resolve(l.Location)
+	if err != nil {
+		return l, err
+	}
+	to := self.fullPath(lU.Location)
+
+	// Make sure the trash exists, then move into it
+	err = os.MkdirAll(filepath.Dir(to), self.DirMode)
+	if err != nil {
+		return l, err
+	}
+	err = os.Rename(from, to)
+	if err != nil {
+		return l, err
+	}
+	self.moveSidecars(from, to, l.Location)
+
+	return lU, nil
+}
+
+func (self *FSDummy) Restore(l FileStoreLocation) (FileStoreLocation, error) {
+	lU := l
+	lU.Location = self.filePath(filepath.Base(l.Location))
+
+	from, err := self.resolve(l.Location)
+	if err != nil {
+		return l, err
+	}
+	to := self.fullPath(lU.Location)
+
+	err = os.MkdirAll(filepath.Dir(to), self.DirMode)
+	if err != nil {
+		return l, err
+	}
+	err = os.Rename(from, to)
+	if err != nil {
+		return l, err
+	}
+	self.moveSidecars(from, to, l.Location)
+
+	return lU, nil
+}
+
+func (self *FSDummy) Purge(l FileStoreLocation) error {
+	fullPath, err := self.resolve(l.Location)
+	if err != nil {
+		return err
+	}
+	for _, v := range dummySidecars {
+		os.Remove(fullPath + v)
+	}
+	return os.Remove(fullPath)
+}
+
+// moveSidecars moves the expiry marker and metadata of file data which has
+// been moved from one path to another, so that they stay with it.
+func (self *FSDummy) moveSidecars(from, to, location string) {
+	for _, v := range dummySidecars {
+		err := os.Rename(from+v, to+v)
+		if err != nil && !os.IsNotExist(err) {
+			log.Print("Unable to move " + v + " file of " + location + " : " + err.Error())
+		}
+	}
+}
+
+// Reshard moves every file under the basepath which isn't stored under the
+// configured layout, along with its expiry marker, to where it belongs.
+// Trashed files are left alone. It returns the number of files moved.
+func (self *FSDummy) Reshard() (int, error) {
+	misplaced := make([]string, 0)
+	err := filepath.Walk(self.BasePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == dummyTrashDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), "file_") && !dummySidecar(path) && path != filepath.Clean(self.fullPath(self.filePath(info.Name()))) {
+			misplaced = append(misplaced, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, path := range misplaced {
+		to := self.fullPath(self.filePath(filepath.Base(path)))
+		err = os.MkdirAll(filepath.Dir(to), self.DirMode)
+		if err == nil {
+			err = os.Rename(path, to)
+		}
+		if err != nil {
+			return i, err
+		}
+		for _, v := range dummySidecars {
+			err = os.Rename(path+v, to+v)
+			if err != nil && !os.IsNotExist(err) {
+				return i + 1, err
+			}
+		}
+	}
+	return len(misplaced), nil
+}
+
+// sweeper periodically removes expired files until Close is called.
+func (self *FSDummy) sweeper(stop chan bool) {
+	t := time.NewTicker(self.SweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			err := self.Sweep()
+			if err != nil {
+				log.Print("Sweep failed : " + err.Error())
+			}
+		}
+	}
+}
+
+// Sweep removes all files under the basepath whose expiry time has passed.
+func (self *FSDummy) Sweep() error {
+	now := time.Now()
+	return filepath.Walk(self.BasePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, dummyExpiresSuffix) {
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		e, err := time.Parse(time.RFC3339, strings.TrimSpace(string(b)))
+		if err != nil || e.After(now) {
+			return nil
+		}
+		err = os.Remove(strings.TrimSuffix(path, dummyExpiresSuffix))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		os.Remove(strings.TrimSuffix(path, dummyExpiresSuffix) + dummyMetadataSuffix)
+		return os.Remove(path)
+	})
+}
+
+// parseFileMode parses octal permissions, ie: 0640.
+func parseFileMode(v string) os.FileMode {
+	m, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || m == 0 || m > 0777 {
+		panic("Unable to parse file mode " + v)
+	}
+	return os.FileMode(m)
+}
@@ -0,0 +1,124 @@
+package fsabstract
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	DUMMY_METADATA_NONE    = ""
+	DUMMY_METADATA_SIDECAR = "sidecar"
+	DUMMY_METADATA_XATTR   = "xattr"
+
+	// dummyMetadataSuffix is appended to the path of a file to name the
+	// sidecar file holding its descriptor.
+	dummyMetadataSuffix = ".json"
+	// dummyMetadataXattr names the extended attribute holding a descriptor.
+	dummyMetadataXattr = "user.fsabstract.descriptor"
+)
+
+var (
+	// dummySidecars lists the suffixes of the files kept beside file data.
+	dummySidecars = []string{dummyExpiresSuffix, dummyMetadataSuffix}
+
+	// errNoXattr is returned when an extended attribute isn't set, or
+	// isn't supported.
+	errNoXattr = errors.New("No extended attribute")
+)
+
+// dummySidecar determines whether a path names a sidecar file.
+func dummySidecar(path string) bool {
+	for _, v := range dummySidecars {
+		if strings.HasSuffix(path, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeMetadata records a descriptor beside the file data at fullPath, as
+// configured. Locations are left out, since they describe where the data
+// is rather than what it is.
+func (self *FSDummy) writeMetadata(fullPath string, d FileStoreDescriptor, size int64) error {
+	if self.Metadata == DUMMY_METADATA_NONE {
+		return nil
+	}
+	d.Location = nil
+	d.Size = size
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if self.Metadata == DUMMY_METADATA_XATTR {
+		return setXattr(fullPath, dummyMetadataXattr, b)
+	}
+	_, err = writeFileAtomic(fullPath+dummyMetadataSuffix, bytes.NewReader(b), self.FileMode, self.DirMode, nil)
+	return err
+}
+
+// readMetadata returns the descriptor recorded beside the file data at
+// fullPath, from a sidecar file or an extended attribute, whichever is
+// present. It returns false if there is neither.
+func (self *FSDummy) readMetadata(fullPath string) (FileStoreDescriptor, bool, error) {
+	var d FileStoreDescriptor
+	b, err := ioutil.ReadFile(fullPath + dummyMetadataSuffix)
+	if os.IsNotExist(err) {
+		b, err = getXattr(fullPath, dummyMetadataXattr)
+		if err == errNoXattr {
+			return d, false, nil
+		}
+	}
+	if err != nil {
+		return d, false, err
+	}
+	err = json.Unmarshal(b, &d)
+	return d, err == nil, err
+}
+
+// Recover rebuilds the descriptors of every file under the basepath from
+// the metadata recorded beside it. Each descriptor has a single location,
+// for this driver. Files with no recorded metadata, and trashed files, are
+// skipped.
+func (self *FSDummy) Recover() ([]FileStoreDescriptor, error) {
+	out := make([]FileStoreDescriptor, 0)
+	err := filepath.Walk(self.BasePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == dummyTrashDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(info.Name(), "file_") || dummySidecar(path) {
+			return nil
+		}
+		d, found, err := self.readMetadata(path)
+		if err != nil || !found {
+			return err
+		}
+		rel, err := filepath.Rel(self.BasePath, path)
+		if err != nil {
+			return err
+		}
+		d.Location = []FileStoreLocation{{
+			Driver:   self.DriverName(),
+			Location: filepath.ToSlash(rel),
+			Created:  info.ModTime(),
+		}}
+		out = append(out, d)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Id < out[j].Id })
+	return out, nil
+}
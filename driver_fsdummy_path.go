@@ -0,0 +1,72 @@
+package fsabstract
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// filePath returns the location, relative to the basepath, at which a file
+// is stored under the configured layout. Locations use forward slashes on
+// every platform.
+func (self *FSDummy) filePath(name string) string {
+	return shardPath(name, self.ShardDepth) + name
+}
+
+// fullPath returns the path of a relative location.
+func (self *FSDummy) fullPath(location string) string {
+	return filepath.Join(self.BasePath, filepath.FromSlash(location))
+}
+
+// resolve returns the path holding the file data for a location, or
+// ErrInvalidLocation if it lies outside the basepath. Legacy locations are
+// accepted if LegacyLocations is set, and files recorded under another
+// layout are looked for under the configured one, in case they have been
+// moved by Reshard.
+func (self *FSDummy) resolve(location string) (string, error) {
+	candidates := make([]string, 0, 3)
+	if self.LegacyLocations && self.legacy(location) {
+		candidates = append(candidates, filepath.Clean(location))
+	}
+	if location != "" && !filepath.IsAbs(location) {
+		candidates = append(candidates, self.fullPath(location))
+	}
+
+	found := ""
+	for _, p := range candidates {
+		if self.contained(p) != nil {
+			continue
+		}
+		if _, err := os.Lstat(p); err == nil {
+			return p, nil
+		}
+		if found == "" {
+			found = p
+		}
+	}
+	if found == "" {
+		return "", ErrInvalidLocation
+	}
+
+	name := filepath.Base(found)
+	if strings.HasPrefix(name, "file_") {
+		p := self.fullPath(self.filePath(name))
+		if _, err := os.Lstat(p); err == nil && self.contained(p) == nil {
+			return p, nil
+		}
+	}
+	return found, nil
+}
+
+// legacy determines whether a location looks like those recorded by older
+// versions, which were absolute or started with the basepath.
+func (self *FSDummy) legacy(location string) bool {
+	return filepath.IsAbs(location) ||
+		strings.HasPrefix(filepath.Clean(location), filepath.Clean(self.BasePath)+string(os.PathSeparator))
+}
+
+// contained checks that a path lies inside the basepath, once any symlinks
+// in the part of it which exists have been followed.
+func (self *FSDummy) contained(p string) error {
+	return containedPath(self.root, self.realRoot, p)
+}
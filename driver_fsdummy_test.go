@@ -2,9 +2,14 @@ package fsabstract
 
 import (
 	//      "errors"
+	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -77,8 +82,348 @@ func TestDummyDriver(t *testing.T) {
 		return
 	}
 
+	if len(fsd.Location) != 0 {
+		t.Error("Location not removed : " + fsd.ToString())
+	}
+
+	testDriverLocations(t, d)
+
 	t.Log("Cleanup")
-	os.Remove(c["fs.dummy.basepath"])
+	os.RemoveAll(c["fs.dummy.basepath"])
 
 	t.Log("Completed dummy file store driver tests")
 }
+
+func TestDummyDriverExpiry(t *testing.T) {
+	t.Log("Testing dummy file store driver expiry")
+
+	basepath, err := ioutil.TempDir("", "fsabstract-expiry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basepath)
+
+	d := GetDriver("dummy")
+	d.Configure(map[string]string{"fs.dummy.basepath": basepath})
+	err = d.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsd := FileStoreDescriptor{
+		Id:      2,
+		Name:    "expired.bin",
+		Size:    4,
+		Created: time.Now(),
+		Expires: time.Now().Add(-time.Minute),
+	}
+	fsd, err = d.Put(fsd, []byte{0x01, 0x02, 0x03, 0x04})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("Get()")
+	_, _, err = d.Get(fsd)
+	if err != ErrNotFound {
+		t.Errorf("Get() of expired file returned %v, expected ErrNotFound", err)
+	}
+
+	t.Log("Sweep()")
+	err = d.(*FSDummy).Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(d.(*FSDummy).fullPath(fsd.Location[0].Location)); !os.IsNotExist(err) {
+		t.Error("Expired file not removed by Sweep()")
+	}
+
+	// The expiry marker follows trashed files
+	fsd, err = d.Put(FileStoreDescriptor{Id: 3, Expires: time.Now().Add(time.Hour)}, []byte("later"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl, err := d.(*FSDummy).Trash(fsd.Location[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(d.(*FSDummy).fullPath(tl.Location) + dummyExpiresSuffix); err != nil {
+		t.Errorf("Expiry marker not trashed : %v", err)
+	}
+	rl, err := d.(*FSDummy).Restore(tl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(d.(*FSDummy).fullPath(rl.Location) + dummyExpiresSuffix); err != nil {
+		t.Errorf("Expiry marker not restored : %v", err)
+	}
+}
+
+func TestDummyDriverSignURL(t *testing.T) {
+	basepath, err := ioutil.TempDir("", "fsabstract-sign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basepath)
+
+	d := &FSDummy{}
+	d.Configure(map[string]string{
+		"fs.dummy.basepath": basepath,
+		"fs.dummy.urlBase":  "http://files.example.com/",
+		"fs.dummy.urlKey":   "secret",
+		"fs.dummy.metadata": DUMMY_METADATA_SIDECAR,
+	})
+	err = d.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsd := FileStoreDescriptor{Id: 1, Name: "a.txt", Expires: time.Now().Add(time.Hour)}
+	l, _ := d.Locate(fsd)
+	s, err := d.SignURL(l, "PUT", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host != "files.example.com" || u.Path != "/signed" {
+		t.Fatalf("Signed URL %s", s)
+	}
+
+	vl, err := d.VerifyURL("PUT", u.Query())
+	if err != nil || vl.Location != l.Location {
+		t.Fatalf("VerifyURL returned %s, %v", vl.ToString(), err)
+	}
+	if id, err := d.LocationId(vl); err != nil || id != 1 {
+		t.Errorf("LocationId returned %d, %v", id, err)
+	}
+	fsd, err = d.WriteLocation(fsd, vl, strings.NewReader("data"))
+	if err != nil || fsd.Size != 4 {
+		t.Fatalf("WriteLocation set size %d, %v", fsd.Size, err)
+	}
+	if b, _ := ioutil.ReadFile(d.fullPath(l.Location)); string(b) != "data" {
+		t.Errorf("Stored %q", b)
+	}
+	// Uploads expire and are described like any other file
+	if _, err = os.Stat(d.fullPath(l.Location) + dummyExpiresSuffix); err != nil {
+		t.Errorf("No expiry marker for upload : %v", err)
+	}
+	if m, ok, err := d.readMetadata(d.fullPath(l.Location)); !ok || m.Name != "a.txt" || m.Size != 4 {
+		t.Errorf("Upload metadata %s, %v", m.ToString(), err)
+	}
+	if _, err = d.LocationId(FileStoreLocation{Location: "other/file_1"}); err != ErrInvalidLocation {
+		t.Errorf("LocationId of a foreign location returned %v", err)
+	}
+
+	// Signatures cover the method, location and expiry time
+	if _, err = d.VerifyURL("GET", u.Query()); err == nil {
+		t.Error("PUT URL accepted for GET")
+	}
+	q := u.Query()
+	q.Set("location", basepath+"/other")
+	if _, err = d.VerifyURL("PUT", q); err == nil {
+		t.Error("Modified location accepted")
+	}
+	s, _ = d.SignURL(l, "GET", -time.Minute)
+	u, _ = url.Parse(s)
+	if _, err = d.VerifyURL("GET", u.Query()); err == nil {
+		t.Error("Expired URL accepted")
+	}
+}
+
+func TestDummyDriverShards(t *testing.T) {
+	basepath, err := ioutil.TempDir("", "fsabstract-shards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basepath)
+
+	// Store a file under the flat layout
+	flat := &FSDummy{BasePath: basepath}
+	if err = flat.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	fsd, err := flat.Put(FileStoreDescriptor{Id: 1, Expires: time.Now().Add(time.Hour)}, []byte("flat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &FSDummy{}
+	d.Configure(map[string]string{"fs.dummy.basepath": basepath, "fs.dummy.shardDepth": "2"})
+	if err = d.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	n, err := d.Reshard()
+	if err != nil || n != 1 {
+		t.Fatalf("Reshard moved %d files, %v", n, err)
+	}
+	sharded := d.filePath("file_1")
+	if len(strings.Split(sharded, "/")) != 3 {
+		t.Errorf("Sharded path %s", sharded)
+	}
+	if _, err = os.Stat(d.fullPath(sharded) + dummyExpiresSuffix); err != nil {
+		t.Error("Expiry marker not moved")
+	}
+	if n, _ = d.Reshard(); n != 0 {
+		t.Errorf("Second Reshard moved %d files", n)
+	}
+
+	// The legacy location remains readable, and is restored to the sharded
+	// layout
+	c, _, err := d.Get(fsd)
+	if err != nil || string(c) != "flat" {
+		t.Fatalf("Get of legacy location returned %q, %v", c, err)
+	}
+	l, err := d.Trash(fsd.Location[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err = d.Restore(l)
+	if err != nil || l.Location != sharded {
+		t.Errorf("Restored to %s, %v", l.Location, err)
+	}
+
+	fsd, err = d.Put(FileStoreDescriptor{Id: 2}, []byte("new"))
+	if err != nil || fsd.Location[0].Location != d.filePath("file_2") {
+		t.Errorf("Put at %s, %v", fsd.Location[0].Location, err)
+	}
+}
+
+func TestDummyDriverAtomicWrite(t *testing.T) {
+	basepath, err := ioutil.TempDir("", "fsabstract-atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basepath)
+
+	d := &FSDummy{}
+	d.Configure(map[string]string{"fs.dummy.basepath": basepath, "fs.dummy.fileMode": "0640"})
+	if err = d.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	fsd, err := d.Put(FileStoreDescriptor{Id: 1}, []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(d.fullPath(fsd.Location[0].Location))
+	if err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("Stored with mode %v, %v", info.Mode().Perm(), err)
+	}
+
+	// A failed write leaves the previous data, and no temporary file
+	_, err = d.WriteLocation(fsd, fsd.Location[0], io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(io.ErrUnexpectedEOF)))
+	if err == nil {
+		t.Fatal("Expected write to fail")
+	}
+	if c, _, _ := d.Get(fsd); string(c) != "first" {
+		t.Errorf("Failed write left %q", c)
+	}
+	if files, _ := ioutil.ReadDir(basepath); len(files) != 1 {
+		t.Errorf("Failed write left %d files", len(files))
+	}
+}
+
+func TestDummyDriverLocations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsabstract-locations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	basepath := dir + string(os.PathSeparator) + "store"
+	secret := dir + string(os.PathSeparator) + "secret"
+	if err = ioutil.WriteFile(secret, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &FSDummy{}
+	d.Configure(map[string]string{"fs.dummy.basepath": basepath})
+	if err = d.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	fsd, err := d.Put(FileStoreDescriptor{Id: 1}, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsd.Location[0].Location != "file_1" {
+		t.Errorf("Stored at %s", fsd.Location[0].Location)
+	}
+	if err = os.Symlink(secret, d.fullPath("file_2")); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(location string) ([]byte, error) {
+		c, _, err := d.Get(FileStoreDescriptor{Location: []FileStoreLocation{{Driver: "dummy", Location: location}}})
+		return c, err
+	}
+	legacy := basepath + string(os.PathSeparator) + "file_1"
+	for _, v := range []string{"../secret", "file_2", secret, legacy} {
+		if _, err = get(v); err != ErrInvalidLocation {
+			t.Errorf("Get of %s returned %v", v, err)
+		}
+	}
+	if _, err = d.WriteLocation(FileStoreDescriptor{}, FileStoreLocation{Location: "../secret"}, strings.NewReader("x")); err != ErrInvalidLocation {
+		t.Errorf("Write outside basepath returned %v", err)
+	}
+
+	// Legacy locations are accepted inside the basepath only
+	d.LegacyLocations = true
+	if c, err := get(legacy); err != nil || string(c) != "data" {
+		t.Errorf("Get of legacy location returned %q, %v", c, err)
+	}
+	for _, v := range []string{secret, basepath + string(os.PathSeparator) + ".." + string(os.PathSeparator) + "secret"} {
+		if _, err = get(v); err != ErrInvalidLocation {
+			t.Errorf("Get of %s returned %v", v, err)
+		}
+	}
+}
+
+func TestDummyDriverRecover(t *testing.T) {
+	for _, mode := range []string{DUMMY_METADATA_SIDECAR, DUMMY_METADATA_XATTR} {
+		basepath, err := ioutil.TempDir("", "fsabstract-recover")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(basepath)
+
+		d := &FSDummy{}
+		d.Configure(map[string]string{"fs.dummy.basepath": basepath, "fs.dummy.metadata": mode, "fs.dummy.shardDepth": "1"})
+		if err = d.Initialize(); err != nil {
+			t.Fatal(err)
+		}
+		want := FileStoreDescriptor{Id: 2, Name: "b.txt", Type: "text/plain", Metadata: map[string]string{"k": "v"}}
+		fsd, err := d.Put(want, []byte("bb"))
+		if err != nil {
+			if mode == DUMMY_METADATA_XATTR && strings.Contains(err.Error(), "not supported") {
+				t.Log("Extended attributes not supported by " + basepath)
+				continue
+			}
+			t.Fatal(err)
+		}
+		trashed, err := d.Put(FileStoreDescriptor{Id: 1, Name: "a.txt"}, []byte("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = d.Trash(trashed.Location[0]); err != nil {
+			t.Fatal(err)
+		}
+		// Without metadata, a file is skipped
+		if err = ioutil.WriteFile(d.fullPath("file_3"), []byte("c"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := d.Recover()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 {
+			t.Fatalf("%s: recovered %d descriptors", mode, len(got))
+		}
+		l := got[0].Location[0]
+		if l.Location != fsd.Location[0].Location || l.Driver != "dummy" {
+			t.Errorf("%s: recovered location %s", mode, l.ToString())
+		}
+		got[0].Location = nil
+		want.Size = 2
+		if !reflect.DeepEqual(got[0], want) {
+			t.Errorf("%s: recovered %s", mode, got[0].ToString())
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package fsabstract
+
+import (
+	"syscall"
+)
+
+const (
+	xattrSupported = true
+)
+
+func setXattr(path, name string, value []byte) error {
+	return syscall.Setxattr(path, name, value, 0)
+}
+
+// getXattr returns the value of an extended attribute, or errNoXattr if
+// it isn't set.
+func getXattr(path, name string) ([]byte, error) {
+	sz, err := syscall.Getxattr(path, name, nil)
+	if err == nil {
+		b := make([]byte, sz)
+		sz, err = syscall.Getxattr(path, name, b)
+		if err == nil {
+			return b[:sz], nil
+		}
+	}
+	if err == syscall.ENODATA || err == syscall.ENOTSUP {
+		return nil, errNoXattr
+	}
+	return nil, err
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package fsabstract
+
+const (
+	xattrSupported = false
+)
+
+func setXattr(path, name string, value []byte) error {
+	return errNoXattr
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	return nil, errNoXattr
+}
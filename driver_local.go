@@ -0,0 +1,726 @@
+package fsabstract
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LOCAL_LAYOUT_FLAT = "flat"
+	LOCAL_LAYOUT_HASH = "hash"
+	LOCAL_LAYOUT_DATE = "date"
+
+	// DefaultLocalShardDepth is the number of directory levels used by the
+	// hash layout, unless another is configured.
+	DefaultLocalShardDepth = 2
+	// DefaultLargeWriteSize is the size from which the large write hook is
+	// used, unless another is configured.
+	DefaultLargeWriteSize = 64 << 20
+
+	// localTrashDir is the subdirectory of the basepath which holds trashed
+	// files, under their original relative paths.
+	localTrashDir = ".trash"
+)
+
+var (
+	// LargeWriteHookMap maps names to large write hooks, for configuration.
+	LargeWriteHookMap = map[string]LargeWriteHook{}
+)
+
+// LargeWriteHook prepares a file which is about to receive size bytes, for
+// example by preallocating its blocks or enabling direct I/O. It returns
+// the writer through which the data is written to f, which may be f itself.
+// Everything written must have reached f once the last Write returns.
+type LargeWriteHook func(f *os.File, size int64) (io.Writer, error)
+
+func init() {
+	FileStoreDriverMap["local"] = func() FileStoreDriver {
+		return new(FSLocal)
+	}
+}
+
+// FSLocal is a local filesystem driver, storing files under a basepath.
+//
+// Files are named file_<hex id>, and placed according to Layout: "flat"
+// puts every file directly in the basepath, "hash" (the default) spreads
+// them across ShardDepth levels of subdirectories named by a hash of the
+// file name, and "date" files them by the descriptor creation date, ie:
+// 2006/01/02/file_<hex>. Locations are recorded relative to the basepath,
+// with the StoreId (by default, the absolute basepath) as their Id, and any
+// location resolving outside the basepath is refused.
+//
+// Files are written atomically, through a temporary file which is synced
+// and renamed into place. Since data is never modified in place, Replicate
+// is able to copy files into another store on the same filesystem with
+// hard links.
+//
+// Quota limits the bytes stored under the basepath, which are counted
+// when the driver is initialized and tracked by this process from then on.
+// Put also refuses to leave less than Reserve bytes free on the disk. Both
+// fail with a *SpaceError before anything is written if the size is known,
+// or as soon as the limit is reached when streaming. Space is held for
+// writes in progress, up front if the size is known and as data is read
+// otherwise, so concurrent writes can't overcommit it. Files of at least
+// LargeWriteSize bytes are prepared by the LargeWrites hook, such as
+// "fallocate" on Linux; others can be registered in LargeWriteHookMap.
+//
+// Expiring files are tracked with a marker file beside the file data, as
+// with FSDummy, and are removed by a background sweeper if SweepInterval is
+// set. Markers aren't counted against the quota.
+type FSLocal struct {
+	BasePath       string      `fsdconfig:"fs.local.basepath"`
+	StoreId        string      `fsdconfig:"fs.local.storeId"`
+	Layout         string      `fsdconfig:"fs.local.layout"`
+	ShardDepth     int         `fsdconfig:"fs.local.shardDepth"`
+	FileMode       os.FileMode `fsdconfig:"fs.local.fileMode"`
+	DirMode        os.FileMode `fsdconfig:"fs.local.dirMode"`
+	Quota          int64       `fsdconfig:"fs.local.quota"`
+	Reserve        int64       `fsdconfig:"fs.local.reserve"`
+	LargeWriteSize int64       `fsdconfig:"fs.local.largeWriteSize"`
+
+	SweepInterval time.Duration `fsdconfig:"fs.local.sweepInterval"`
+
+	LargeWrites string         `fsdconfig:"fs.local.largeWrites"`
+	LargeWriter LargeWriteHook // populated by LargeWrites
+
+	driver   string // name recorded in locations, if not "local"
+	root     string // absolute BasePath
+	realRoot string // root with symlinks resolved
+	lock     sync.Mutex
+	usage    int64 // bytes stored, including space held by writes in progress
+	pending  int64 // bytes held by writes in progress but not yet written
+
+	stopSweep chan bool
+}
+
+func (self *FSLocal) DriverName() string {
+	if self.driver != "" {
+		return self.driver
+	}
+	return "local"
+}
+
+func (self *FSLocal) Configure(c map[string]string) {
+	if v, exists := c["fs.local.basepath"]; exists {
+		self.BasePath = v
+	}
+	if v, exists := c["fs.local.storeId"]; exists {
+		self.StoreId = v
+	}
+	if v, exists := c["fs.local.layout"]; exists {
+		if v != LOCAL_LAYOUT_FLAT && v != LOCAL_LAYOUT_HASH && v != LOCAL_LAYOUT_DATE {
+			panic("Unknown local layout " + v)
+		}
+		self.Layout = v
+	}
+	if v, exists := c["fs.local.shardDepth"]; exists {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > dummyMaxShardDepth {
+			panic("Unable to use shard depth " + v)
+		}
+		self.ShardDepth = n
+	}
+	if v, exists := c["fs.local.fileMode"]; exists {
+		self.FileMode = parseFileMode(v)
+	}
+	if v, exists := c["fs.local.dirMode"]; exists {
+		self.DirMode = parseFileMode(v)
+	}
+	if v, exists := c["fs.local.quota"]; exists {
+		self.Quota = localSize(v)
+	}
+	if v, exists := c["fs.local.reserve"]; exists {
+		self.Reserve = localSize(v)
+	}
+	if v, exists := c["fs.local.largeWriteSize"]; exists {
+		self.LargeWriteSize = localSize(v)
+	}
+	if v, exists := c["fs.local.largeWrites"]; exists {
+		if _, exists := LargeWriteHookMap[v]; !exists && v != "" {
+			panic("Unknown large write hook " + v)
+		}
+		self.LargeWrites = v
+		self.LargeWriter = LargeWriteHookMap[v]
+	}
+	if v, exists := c["fs.local.sweepInterval"]; exists {
+		i, err := time.ParseDuration(v)
+		if err != nil {
+			panic("Unable to parse sweep interval " + v)
+		}
+		self.SweepInterval = i
+	}
+}
+
+func (self *FSLocal) Initialize() error {
+	if self.BasePath == "" {
+		return errors.New("No local basepath configured")
+	}
+	if self.Layout == "" {
+		self.Layout = LOCAL_LAYOUT_HASH
+	}
+	if self.ShardDepth == 0 {
+		self.ShardDepth = DefaultLocalShardDepth
+	}
+	if self.FileMode == 0 {
+		self.FileMode = DefaultFileMode
+	}
+	if self.DirMode == 0 {
+		self.DirMode = DefaultDirMode
+	}
+	if self.LargeWriteSize == 0 {
+		self.LargeWriteSize = DefaultLargeWriteSize
+	}
+	if self.LargeWriter == nil && self.LargeWrites != "" {
+		self.LargeWriter = LargeWriteHookMap[self.LargeWrites]
+		if self.LargeWriter == nil {
+			return errors.New("Unknown large write hook " + self.LargeWrites)
+		}
+	}
+
+	err := os.MkdirAll(self.BasePath, self.DirMode)
+	if err != nil {
+		return err
+	}
+	self.root, err = filepath.Abs(self.BasePath)
+	if err != nil {
+		return err
+	}
+	self.realRoot, err = filepath.EvalSymlinks(self.root)
+	if err != nil {
+		return err
+	}
+	if self.StoreId == "" {
+		self.StoreId = self.root
+	}
+
+	// Count what is already stored, against the quota
+	if self.Quota > 0 {
+		var usage int64
+		err = filepath.Walk(self.BasePath, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() && !strings.HasSuffix(path, dummyExpiresSuffix) {
+				usage += info.Size()
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		self.lock.Lock()
+		self.usage = usage
+		self.lock.Unlock()
+	}
+	if self.SweepInterval > 0 && self.stopSweep == nil {
+		self.stopSweep = make(chan bool)
+		go self.sweeper(self.stopSweep)
+	}
+	return nil
+}
+
+// Close stops the background sweeper, if it is running.
+func (self *FSLocal) Close() error {
+	if self.stopSweep != nil {
+		close(self.stopSweep)
+		self.stopSweep = nil
+	}
+	return nil
+}
+
+func (self *FSLocal) Get(d FileStoreDescriptor) ([]byte, FileStoreLocation, error) {
+	// Find the pertinent FileStoreLocation
+	l := LocationsForStore(d, self.DriverName(), self.StoreId)
+	if len(l) == 0 {
+		return nil, FileStoreLocation{}, errors.New("Store " + self.StoreId + " not found : " + d.ToString())
+	}
+	c, err := self.GetFrom(d, l[0])
+	return c, l[0], err
+}
+
+// GetFrom retrieves the file data at a specific location of a descriptor.
+func (self *FSLocal) GetFrom(d FileStoreDescriptor, l FileStoreLocation) ([]byte, error) {
+	fullPath, err := self.locate(l)
+	if err != nil {
+		return nil, err
+	}
+	if d.Expired() {
+		return nil, ErrNotFound
+	}
+
+	// Retrieve actual file data from disk
+	c, err := ioutil.ReadFile(fullPath)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Send everything back
+	return c, nil
+}
+
+func (self *FSLocal) Put(d FileStoreDescriptor, c []byte) (FileStoreDescriptor, error) {
+	dU, _, err := self.put(d, bytes.NewReader(c), int64(len(c)))
+	return dU, err
+}
+
+func (self *FSLocal) PutReader(d FileStoreDescriptor, r io.Reader) (FileStoreDescriptor, error) {
+	dU, n, err := self.put(d, r, -1)
+	if err != nil {
+		return dU, err
+	}
+	dU.Size = n
+	return dU, nil
+}
+
+// put stores size bytes read from r, or everything until EOF if size is
+// -1, returning the number of bytes stored.
+func (self *FSLocal) put(d FileStoreDescriptor, r io.Reader, size int64) (FileStoreDescriptor, int64, error) {
+	dU := d
+
+	// Create new location
+	l := FileStoreLocation{
+		Id:       self.StoreId,
+		Driver:   self.DriverName(),
+		Created:  time.Now(),
+		Location: self.filePath(dU),
+	}
+	fullPath := self.fullPath(l.Location)
+	var replaced int64
+	if info, err := os.Stat(fullPath); err == nil {
+		replaced = info.Size()
+	}
+
+	// Make sure it fits, and hold the space while writing. The file being
+	// replaced is credited against the quota.
+	w := &localWrite{Reader: r, local: self, replaced: replaced, sized: size >= 0}
+	if size >= 0 {
+		err := self.reserve(size, replaced, true)
+		if err != nil {
+			return dU, 0, err
+		}
+		w.held = size
+	}
+	defer w.release()
+
+	// Push out to filesystem
+	var prepare func(*os.File) (io.Writer, error)
+	hint := size
+	if hint < 0 {
+		hint = d.Size
+	}
+	if self.LargeWriter != nil && hint >= self.LargeWriteSize {
+		prepare = func(f *os.File) (io.Writer, error) {
+			return self.LargeWriter(f, hint)
+		}
+	}
+	n, err := writeFileAtomic(fullPath, w, self.FileMode, self.DirMode, prepare)
+	if err != nil {
+		return dU, n, err
+	}
+	self.claim(n - replaced)
+	err = self.expire(fullPath, d)
+	if err != nil {
+		return dU, n, err
+	}
+
+	// Append location
+	dU = AddLocation(dU, l)
+
+	// No errors, send back
+	return dU, n, nil
+}
+
+func (self *FSLocal) Delete(d FileStoreDescriptor, l FileStoreLocation) (FileStoreDescriptor, error) {
+	dU := d
+
+	// Find the pertinent FileStoreLocation, if we weren't given one
+	if l.Driver == "" && l.Location == "" {
+		ls := LocationsForStore(d, self.DriverName(), self.StoreId)
+		if len(ls) == 0 {
+			return dU, errors.New("Store " + self.StoreId + " not found : " + d.ToString())
+		}
+		l = ls[0]
+	}
+
+	// Delete from disk
+	err := self.remove(l)
+	if err != nil {
+		return dU, err
+	}
+
+	// Remove from mapping
+	dU = RemoveLocation(dU, l)
+
+	// No errors, send back
+	return dU, nil
+}
+
+func (self *FSLocal) Trash(l FileStoreLocation) (FileStoreLocation, error) {
+	lU := l
+	lU.Location = localTrashDir + "/" + l.Location
+	return self.move(l, lU)
+}
+
+func (self *FSLocal) Restore(l FileStoreLocation) (FileStoreLocation, error) {
+	lU := l
+	lU.Location = strings.TrimPrefix(l.Location, localTrashDir+"/")
+	return self.move(l, lU)
+}
+
+func (self *FSLocal) Purge(l FileStoreLocation) error {
+	return self.remove(l)
+}
+
+// Replicate copies the file data at a location into another store, adding
+// the new location to the descriptor. Within a filesystem, the copy is a
+// hard link, which takes no space or time; otherwise the data is copied.
+// Either way, it counts against the quota of the other store.
+func (self *FSLocal) Replicate(d FileStoreDescriptor, l FileStoreLocation, to *FSLocal) (FileStoreDescriptor, error) {
+	from, err := self.locate(l)
+	if err != nil {
+		return d, err
+	}
+	info, err := os.Stat(from)
+	if err != nil {
+		return d, err
+	}
+
+	nl := FileStoreLocation{
+		Id:       to.StoreId,
+		Driver:   to.DriverName(),
+		Created:  time.Now(),
+		Location: to.filePath(d),
+	}
+	toPath := to.fullPath(nl.Location)
+	err = os.MkdirAll(filepath.Dir(toPath), to.DirMode)
+	if err != nil {
+		return d, err
+	}
+	// A link takes no disk space, but still counts against the quota
+	if to.Quota > 0 {
+		to.lock.Lock()
+		available := to.Quota - to.usage
+		if info.Size() > available {
+			to.lock.Unlock()
+			return d, &SpaceError{Path: to.BasePath, Size: info.Size(), Available: available, Quota: true}
+		}
+		to.usage += info.Size()
+		to.lock.Unlock()
+	}
+	if os.Link(from, toPath) == nil {
+		if to.Quota <= 0 {
+			to.claim(info.Size())
+		}
+		err = to.expire(toPath, d)
+		if err != nil {
+			return d, err
+		}
+		return AddLocation(d, nl), nil
+	}
+	if to.Quota > 0 {
+		to.claim(-info.Size())
+	}
+
+	// Different filesystems, or links aren't supported
+	f, err := os.Open(from)
+	if err != nil {
+		return d, err
+	}
+	defer f.Close()
+	dU, _, err := to.put(d, f, info.Size())
+	return dU, err
+}
+
+// filePath returns the location, relative to the basepath, for the file
+// data of a descriptor under the configured layout.
+func (self *FSLocal) filePath(d FileStoreDescriptor) string {
+	name := "file_" + strconv.FormatInt(d.Id, 16) // hex
+	switch self.Layout {
+	case LOCAL_LAYOUT_FLAT:
+		return name
+	case LOCAL_LAYOUT_DATE:
+		t := d.Created
+		if t.IsZero() {
+			t = time.Now()
+		}
+		return t.UTC().Format("2006/01/02/") + name
+	}
+	return shardPath(name, self.ShardDepth) + name
+}
+
+// fullPath returns the path of a relative location.
+func (self *FSLocal) fullPath(location string) string {
+	return filepath.Join(self.BasePath, filepath.FromSlash(location))
+}
+
+// locate returns the path holding the file data for a location of this
+// store, or ErrInvalidLocation if it lies outside the basepath.
+func (self *FSLocal) locate(l FileStoreLocation) (string, error) {
+	err := checkLocation(l, self.DriverName())
+	if err != nil {
+		return "", err
+	}
+	if l.Id != self.StoreId {
+		return "", errors.New("Location not in store " + self.StoreId + " : " + l.ToString())
+	}
+	if l.Location == "" || filepath.IsAbs(l.Location) {
+		return "", ErrInvalidLocation
+	}
+	p := self.fullPath(l.Location)
+	return p, containedPath(self.root, self.realRoot, p)
+}
+
+// move renames the file data at one location to another.
+func (self *FSLocal) move(from, to FileStoreLocation) (FileStoreLocation, error) {
+	fromPath, err := self.locate(from)
+	if err != nil {
+		return from, err
+	}
+	toPath, err := self.locate(to)
+	if err != nil {
+		return from, err
+	}
+	err = os.MkdirAll(filepath.Dir(toPath), self.DirMode)
+	if err != nil {
+		return from, err
+	}
+	err = os.Rename(fromPath, toPath)
+	if err != nil {
+		return from, err
+	}
+	err = os.Rename(fromPath+dummyExpiresSuffix, toPath+dummyExpiresSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return to, err
+	}
+	return to, nil
+}
+
+// expire records the expiry time of a descriptor in a marker file beside
+// its file data, or removes a stale marker if it doesn't expire.
+func (self *FSLocal) expire(fullPath string, d FileStoreDescriptor) error {
+	if !d.Expires.IsZero() {
+		_, err := writeFileAtomic(fullPath+dummyExpiresSuffix, strings.NewReader(d.Expires.Format(time.RFC3339)), self.FileMode, self.DirMode, nil)
+		return err
+	}
+	err := os.Remove(fullPath + dummyExpiresSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// remove deletes the file data at a location, releasing its space.
+func (self *FSLocal) remove(l FileStoreLocation) error {
+	fullPath, err := self.locate(l)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return self.removePath(fullPath, info)
+}
+
+// removePath deletes the file data at a path and its expiry marker,
+// releasing its space.
+func (self *FSLocal) removePath(fullPath string, info os.FileInfo) error {
+	err := os.Remove(fullPath)
+	if err != nil {
+		return err
+	}
+	self.claim(-info.Size())
+	err = os.Remove(fullPath + dummyExpiresSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// sweeper periodically removes expired files until Close is called.
+func (self *FSLocal) sweeper(stop chan bool) {
+	t := time.NewTicker(self.SweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			err := self.Sweep()
+			if err != nil {
+				log.Print("Sweep failed : " + err.Error())
+			}
+		}
+	}
+}
+
+// Sweep removes all files under the basepath whose expiry time has passed.
+func (self *FSLocal) Sweep() error {
+	now := time.Now()
+	return filepath.Walk(self.BasePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, dummyExpiresSuffix) {
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		e, err := time.Parse(time.RFC3339, strings.TrimSpace(string(b)))
+		if err != nil || e.After(now) {
+			return nil
+		}
+		fullPath := strings.TrimSuffix(path, dummyExpiresSuffix)
+		data, err := os.Stat(fullPath)
+		if os.IsNotExist(err) {
+			return os.Remove(path)
+		}
+		if err != nil {
+			return err
+		}
+		return self.removePath(fullPath, data)
+	})
+}
+
+// space returns the number of bytes which can still be stored, or -1 if
+// there is no limit, and whether the quota is what limits it.
+func (self *FSLocal) space() (int64, bool, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.spaceLocked(0)
+}
+
+// spaceLocked is space, with credit bytes of the quota treated as free. It
+// must be called with the lock held.
+func (self *FSLocal) spaceLocked(credit int64) (int64, bool, error) {
+	available := int64(-1)
+	quota := false
+	if self.Quota > 0 {
+		available = self.Quota - self.usage + credit
+		quota = true
+	}
+	free, err := diskFree(self.BasePath)
+	if err != nil {
+		return 0, false, err
+	}
+	if free >= 0 {
+		free -= self.Reserve + self.pending
+		if free < 0 {
+			free = 0
+		}
+		if available < 0 || free < available {
+			available = free
+			quota = false
+		}
+	}
+	if available < 0 && quota {
+		available = 0
+	}
+	return available, quota, nil
+}
+
+// claim adjusts the bytes counted against the quota.
+func (self *FSLocal) claim(n int64) {
+	self.lock.Lock()
+	self.usage += n
+	self.lock.Unlock()
+}
+
+// reserve holds n bytes for a write, crediting replaced bytes against the
+// quota, or fails with a *SpaceError if they don't fit. The check and the
+// hold are made under one lock. Bytes which are pending, ie: not yet read
+// from the writer, are also held against the free disk space.
+func (self *FSLocal) reserve(n, replaced int64, pending bool) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	available, quota, err := self.spaceLocked(replaced)
+	if err != nil {
+		return err
+	}
+	if available >= 0 && n > available {
+		return &SpaceError{Path: self.BasePath, Size: n, Available: available, Quota: quota}
+	}
+	self.usage += n
+	if pending {
+		self.pending += n
+	}
+	return nil
+}
+
+// localSize parses a configured size, panicking if it is invalid.
+func localSize(v string) int64 {
+	n, err := parseSize(v)
+	if err != nil {
+		panic(err.Error())
+	}
+	return n
+}
+
+// localWrite reads the data for a write, holding space for it. A sized
+// write holds its space up front, and releases its pending bytes as they
+// are read; otherwise each read is held as it arrives, failing with a
+// *SpaceError once nothing more fits.
+type localWrite struct {
+	io.Reader
+	local    *FSLocal
+	replaced int64
+	sized    bool
+	held     int64 // bytes counted in usage
+	read     int64
+}
+
+func (self *localWrite) Read(p []byte) (int, error) {
+	n, err := self.Reader.Read(p)
+	if n == 0 {
+		return n, err
+	}
+	if self.sized {
+		written := int64(n)
+		if self.read+written > self.held {
+			written = self.held - self.read
+		}
+		self.read += int64(n)
+		self.local.lock.Lock()
+		self.local.pending -= written
+		self.local.lock.Unlock()
+		if self.read > self.held {
+			return n, errors.New("More data than expected for " + self.local.BasePath)
+		}
+		return n, err
+	}
+	self.read += int64(n)
+	rerr := self.local.reserve(int64(n), self.replaced, false)
+	if se, ok := rerr.(*SpaceError); ok {
+		se.Size = -1
+		se.Available += self.held
+	}
+	if rerr != nil {
+		return n, rerr
+	}
+	self.held += int64(n)
+	return n, err
+}
+
+// release gives back the space held, once the write is over.
+func (self *localWrite) release() {
+	self.local.lock.Lock()
+	self.local.usage -= self.held
+	if self.sized && self.held > self.read {
+		self.local.pending -= self.held - self.read
+	}
+	self.local.lock.Unlock()
+}
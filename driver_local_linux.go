@@ -0,0 +1,31 @@
+package fsabstract
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	// fallocKeepSize preallocates blocks without changing the file size,
+	// so that a size hint which turns out too large leaves no padding.
+	fallocKeepSize = 0x01
+)
+
+func init() {
+	LargeWriteHookMap["fallocate"] = fallocateHook
+}
+
+// fallocateHook preallocates the blocks for a file, so that it is laid out
+// contiguously and a lack of space is detected before writing.
+func fallocateHook(f *os.File, size int64) (io.Writer, error) {
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+	if err == syscall.EOPNOTSUPP {
+		// Not supported by this filesystem, so just write
+		return f, nil
+	}
+	if err == syscall.ENOSPC {
+		return nil, &SpaceError{Path: f.Name(), Size: size, Available: 0}
+	}
+	return f, err
+}
@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd)
+
+package fsabstract
+
+// diskFree returns -1, since free space can't be determined on this
+// platform. Only quotas are enforced.
+func diskFree(path string) (int64, error) {
+	return -1, nil
+}
@@ -0,0 +1,275 @@
+package fsabstract
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testLocalDriver(t *testing.T, c map[string]string) (*FSLocal, func()) {
+	dir, err := ioutil.TempDir("", "fsabstract-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &FSLocal{}
+	d.Configure(map[string]string{"fs.local.basepath": filepath.Join(dir, "store")})
+	d.Configure(c)
+	if err = d.Initialize(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return d, func() { os.RemoveAll(dir) }
+}
+
+func TestLocalDriver(t *testing.T) {
+	created := time.Date(2017, 3, 4, 12, 0, 0, 0, time.UTC)
+	for layout, expected := range map[string]string{
+		LOCAL_LAYOUT_FLAT: "file_1f",
+		LOCAL_LAYOUT_HASH: shardPath("file_1f", 2) + "file_1f",
+		LOCAL_LAYOUT_DATE: "2017/03/04/file_1f",
+	} {
+		d, cleanup := testLocalDriver(t, map[string]string{"fs.local.layout": layout})
+		defer cleanup()
+
+		fsd, err := d.Put(FileStoreDescriptor{Id: 31, Created: created}, []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l := fsd.Location[0]; l.Location != expected || l.Id != d.root {
+			t.Errorf("%s layout stored at %s in %s", layout, l.Location, l.Id)
+		}
+		if c, _, err := d.Get(fsd); err != nil || string(c) != "data" {
+			t.Errorf("%s layout Get returned %q, %v", layout, c, err)
+		}
+
+		// Trash and restore
+		tl, err := d.Trash(fsd.Location[0])
+		if err != nil || tl.Location != localTrashDir+"/"+expected {
+			t.Fatalf("Trash returned %v, %v", tl, err)
+		}
+		rl, err := d.Restore(tl)
+		if err != nil || rl.Location != expected {
+			t.Fatalf("Restore returned %v, %v", rl, err)
+		}
+
+		testDriverLocations(t, d)
+	}
+
+	d, cleanup := testLocalDriver(t, nil)
+	defer cleanup()
+	for _, v := range []string{"../secret", "/etc/passwd", "a/../../secret"} {
+		_, _, err := d.Get(FileStoreDescriptor{Location: []FileStoreLocation{{Driver: "local", Id: d.StoreId, Location: v}}})
+		if err != ErrInvalidLocation {
+			t.Errorf("Get of %s returned %v", v, err)
+		}
+	}
+}
+
+func TestLocalDriverSpace(t *testing.T) {
+	d, cleanup := testLocalDriver(t, map[string]string{"fs.local.quota": "10"})
+	defer cleanup()
+
+	fsd, err := d.Put(FileStoreDescriptor{Id: 1}, []byte("12345678"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Put(FileStoreDescriptor{Id: 2}, []byte("12345"))
+	var se *SpaceError
+	if !errors.As(err, &se) || !errors.Is(err, ErrNoSpace) || !se.Quota || se.Available != 2 {
+		t.Fatalf("Put over quota returned %v", err)
+	}
+	_, err = d.PutReader(FileStoreDescriptor{Id: 3}, strings.NewReader("12345"))
+	if !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("Streamed Put over quota returned %v", err)
+	}
+	files := 0
+	filepath.Walk(d.BasePath, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			files++
+		}
+		return err
+	})
+	if files != 1 {
+		t.Errorf("Failed Put left %d files", files)
+	}
+
+	// Overwriting only needs the difference, and releases space
+	if _, err = d.Put(fsd, []byte("123456789")); err != nil {
+		t.Fatalf("Overwrite within quota returned %v", err)
+	}
+	if _, err = d.Put(fsd, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.Put(FileStoreDescriptor{Id: 2}, []byte("12345")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reserve applies to the whole disk
+	free, _ := diskFree(d.BasePath)
+	if free < 0 {
+		t.Skip("Free space not available on this platform")
+	}
+	r, cleanup := testLocalDriver(t, map[string]string{"fs.local.reserve": "1T"})
+	defer cleanup()
+	r.Reserve = free
+	if _, err = r.Put(FileStoreDescriptor{Id: 1}, []byte("data")); !errors.As(err, &se) || se.Quota {
+		t.Errorf("Put into reserve returned %v", err)
+	}
+}
+
+func TestLocalDriverSweep(t *testing.T) {
+	d, cleanup := testLocalDriver(t, map[string]string{"fs.local.quota": "100"})
+	defer cleanup()
+
+	expired, err := d.Put(FileStoreDescriptor{Id: 1, Expires: time.Now().Add(-time.Minute)}, []byte("expired"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	later, err := d.Put(FileStoreDescriptor{Id: 2, Expires: time.Now().Add(time.Hour)}, []byte("later"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = d.Get(expired); err != ErrNotFound {
+		t.Errorf("Get of expired file returned %v", err)
+	}
+
+	// The marker follows trashed files
+	tl, err := d.Trash(later.Location[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(d.fullPath(tl.Location) + dummyExpiresSuffix); err != nil {
+		t.Errorf("Expiry marker not trashed : %v", err)
+	}
+
+	if err = d.Sweep(); err != nil {
+		t.Fatal(err)
+	}
+	p := d.fullPath(expired.Location[0].Location)
+	if _, err = os.Stat(p); !os.IsNotExist(err) {
+		t.Error("Expired file not removed by Sweep")
+	}
+	if _, err = os.Stat(p + dummyExpiresSuffix); !os.IsNotExist(err) {
+		t.Error("Expiry marker not removed by Sweep")
+	}
+	if _, err = os.Stat(d.fullPath(tl.Location)); err != nil {
+		t.Errorf("Unexpired file removed by Sweep : %v", err)
+	}
+	if available, _, _ := d.space(); available != 95 {
+		t.Errorf("Sweep left %d bytes available, expected 95", available)
+	}
+
+	// Overwriting without an expiry removes the marker
+	if _, err = d.Put(FileStoreDescriptor{Id: 3, Expires: time.Now().Add(time.Hour)}, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	kept, err := d.Put(FileStoreDescriptor{Id: 3}, []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(d.fullPath(kept.Location[0].Location) + dummyExpiresSuffix); !os.IsNotExist(err) {
+		t.Error("Stale expiry marker kept")
+	}
+}
+
+func TestLocalDriverConcurrentSpace(t *testing.T) {
+	d, cleanup := testLocalDriver(t, map[string]string{"fs.local.quota": "100", "fs.local.layout": "flat"})
+	defer cleanup()
+
+	// Streams hold space as they are read, so they can't each be given
+	// the whole quota
+	results := make(chan error, 3)
+	writers := make([]*io.PipeWriter, 3)
+	for i := range writers {
+		r, w := io.Pipe()
+		writers[i] = w
+		go func(id int64) {
+			_, err := d.PutReader(FileStoreDescriptor{Id: id}, r)
+			r.CloseWithError(err)
+			results <- err
+		}(int64(i + 1))
+	}
+	for _, w := range writers {
+		w.Write(make([]byte, 40))
+	}
+	for _, w := range writers {
+		w.Close()
+	}
+	failed := 0
+	for range writers {
+		if err := <-results; errors.Is(err, ErrNoSpace) {
+			failed++
+		} else if err != nil {
+			t.Error(err)
+		}
+	}
+	if available, _, _ := d.space(); failed != 1 || available != 20 {
+		t.Errorf("%d streams failed, leaving %d bytes", failed, available)
+	}
+}
+
+func TestLocalDriverLargeWrites(t *testing.T) {
+	var hinted int64
+	LargeWriteHookMap["test"] = func(f *os.File, size int64) (io.Writer, error) {
+		hinted = size
+		return f, nil
+	}
+	defer delete(LargeWriteHookMap, "test")
+
+	d, cleanup := testLocalDriver(t, map[string]string{"fs.local.largeWrites": "test", "fs.local.largeWriteSize": "4"})
+	defer cleanup()
+	if _, err := d.Put(FileStoreDescriptor{Id: 1}, []byte("abc")); err != nil || hinted != 0 {
+		t.Errorf("Small Put hinted %d, %v", hinted, err)
+	}
+	if _, err := d.Put(FileStoreDescriptor{Id: 2}, []byte("abcdef")); err != nil || hinted != 6 {
+		t.Errorf("Large Put hinted %d, %v", hinted, err)
+	}
+	if h, exists := LargeWriteHookMap["fallocate"]; exists {
+		d.LargeWriter = h
+		fsd, err := d.Put(FileStoreDescriptor{Id: 3}, []byte("preallocated"))
+		if c, _, _ := d.Get(fsd); err != nil || string(c) != "preallocated" {
+			t.Errorf("Preallocated Put stored %q, %v", c, err)
+		}
+	}
+}
+
+func TestLocalDriverReplicate(t *testing.T) {
+	from, cleanup := testLocalDriver(t, nil)
+	defer cleanup()
+	to := &FSLocal{}
+	to.Configure(map[string]string{"fs.local.basepath": filepath.Join(filepath.Dir(from.BasePath), "replica"), "fs.local.layout": "flat"})
+	if err := to.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	fsd, err := from.Put(FileStoreDescriptor{Id: 1}, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsd, err = from.Replicate(fsd, fsd.Location[0], to)
+	if err != nil || len(fsd.Location) != 2 || fsd.Location[1].Id != to.StoreId {
+		t.Fatalf("Replicate returned %v, %v", fsd.Location, err)
+	}
+	a, _ := os.Stat(from.fullPath(fsd.Location[0].Location))
+	b, _ := os.Stat(to.fullPath(fsd.Location[1].Location))
+	if !os.SameFile(a, b) {
+		t.Error("Replica isn't a hard link")
+	}
+
+	// Each store reads its own copy
+	if c, l, err := to.Get(fsd); err != nil || string(c) != "data" || l.Id != to.StoreId {
+		t.Errorf("Get of replica returned %q from %v, %v", c, l, err)
+	}
+	fsd, err = from.Delete(fsd, FileStoreLocation{})
+	if err != nil || len(fsd.Location) != 1 {
+		t.Fatalf("Delete returned %v, %v", fsd.Location, err)
+	}
+	if c, _, err := to.Get(fsd); err != nil || string(c) != "data" {
+		t.Errorf("Get of replica after Delete returned %q, %v", c, err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package fsabstract
+
+import (
+	"syscall"
+)
+
+// diskFree returns the number of bytes available to unprivileged users on
+// the filesystem holding path, or -1 if it can't be determined.
+func diskFree(path string) (int64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return -1, err
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), nil
+}
@@ -1,6 +1,9 @@
 package fsabstract
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	memcache "github.com/bradfitz/gomemcache/memcache"
 	"strconv"
@@ -8,6 +11,25 @@ import (
 	"time"
 )
 
+const (
+	// memcacheFlagHeader marks items whose value is prefixed by a header
+	// line holding the size and type of the file, as "<size> <type>\n".
+	// Items written before the header was introduced have no flags.
+	memcacheFlagHeader = 1 << 0
+	// memcacheFlagExpires marks headers which also hold the expiry, as a
+	// unix time, in "<size> <expires> <type>\n". memcache can't report
+	// the expiry of an item, so it is kept for moves.
+	memcacheFlagExpires = 1 << 1
+
+	// memcacheOptionCas is the FileStoreLocation option holding the CAS id
+	// of the item last written to the location. It is no longer written,
+	// but is still honoured for locations which hold it.
+	memcacheOptionCas = "cas"
+	// memcacheOptionChecksum is the FileStoreLocation option holding a
+	// checksum of the item last written to the location.
+	memcacheOptionChecksum = "checksum"
+)
+
 func init() {
 	FileStoreDriverMap["memcache"] = func() FileStoreDriver {
 		return new(FSMemcache)
@@ -18,9 +40,24 @@ func init() {
 // separated by commas, for the memcache instances. This is a terrible idea
 // for anything other than testing, since memcache doesn't persist anywhere
 // besides memory.
+//
+// Files are stored with their size and type, and expire at the
+// FileStoreDescriptor expiry or, failing that, after Expiration if it is
+// set. Types can't hold line breaks. Writes use CAS, so a Put which races
+// another writer for the same key fails with ErrConflict rather than
+// overwriting it. Put records a checksum of the value in the "checksum"
+// option of the location; an overwrite reads the CAS id of the current
+// item and only replaces it if it still matches, and a Put to an occupied
+// key without one is a conflict. Timeout and MaxIdle are passed through to
+// the memcache client.
 type FSMemcache struct {
-	Servers    string   `fsdconfig:"fs.memcache.servers"`
-	ServerList []string // populated by Servers
+	Servers    string        `fsdconfig:"fs.memcache.servers"`
+	ServerList []string      // populated by Servers
+	Expiration time.Duration `fsdconfig:"fs.memcache.expiration"`
+	Timeout    time.Duration `fsdconfig:"fs.memcache.timeout"`
+	MaxIdle    int           `fsdconfig:"fs.memcache.maxIdle"`
+	KeyNaming  string        `fsdconfig:"fs.memcache.keyNaming"`
+	Namer      KeyNamer      // populated by KeyNaming
 
 	conn *memcache.Client
 }
@@ -40,13 +77,51 @@ func (self *FSMemcache) Configure(c map[string]string) {
 			}
 		}
 	}
+	if v, exists := c["fs.memcache.expiration"]; exists {
+		t, err := time.ParseDuration(v)
+		if err != nil {
+			panic("Unable to parse memcache expiration " + v)
+		}
+		self.Expiration = t
+	}
+	if v, exists := c["fs.memcache.timeout"]; exists {
+		t, err := time.ParseDuration(v)
+		if err != nil {
+			panic("Unable to parse memcache timeout " + v)
+		}
+		self.Timeout = t
+	}
+	if v, exists := c["fs.memcache.maxIdle"]; exists {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			panic("Unable to parse memcache max idle connections " + v)
+		}
+		self.MaxIdle = n
+	}
+	if v, exists := c["fs.memcache.keyNaming"]; exists {
+		self.KeyNaming = v
+	}
+	n, err := newKeyNamer(self.KeyNaming, "fs.memcache.", c)
+	if err != nil {
+		panic(err.Error())
+	}
+	self.Namer = n
 }
 
 func (self *FSMemcache) Initialize() error {
+	if self.Namer == nil {
+		n, err := newKeyNamer(self.KeyNaming, "fs.memcache.", nil)
+		if err != nil {
+			return err
+		}
+		self.Namer = n
+	}
 	self.conn = memcache.New(self.ServerList...)
 	if self.conn == nil {
 		return errors.New("Unable to initialize memcache driver")
 	}
+	self.conn.Timeout = self.Timeout
+	self.conn.MaxIdleConns = self.MaxIdle
 	return nil
 }
 
@@ -56,22 +131,42 @@ func (self *FSMemcache) Get(d FileStoreDescriptor) ([]byte, FileStoreLocation, e
 	if err != nil {
 		return nil, FileStoreLocation{}, err
 	}
+	c, err := self.GetFrom(d, l)
+	return c, l, err
+}
+
+// GetFrom retrieves the file data at a specific location of a descriptor.
+func (self *FSMemcache) GetFrom(d FileStoreDescriptor, l FileStoreLocation) ([]byte, error) {
+	err := checkLocation(l, self.DriverName())
+	if err != nil {
+		return nil, err
+	}
+	if d.Expired() {
+		return nil, ErrNotFound
+	}
 
 	// Retrieve actual file data from disk
-	c, err := self.conn.Get(l.Location)
+	i, err := self.conn.Get(l.Location)
 	if err != nil {
-		return nil, l, err
+		return nil, memcacheError(err)
+	}
+	c, _, _, err := memcacheDecode(i)
+	if err != nil {
+		return nil, err
 	}
 
 	// Send everything back
-	return c.Value, l, nil
+	return c, nil
 }
 
 func (self *FSMemcache) Put(d FileStoreDescriptor, c []byte) (FileStoreDescriptor, error) {
 	dU := d
+	if strings.ContainsAny(dU.Type, "\r\n") {
+		return dU, errors.New("Invalid memcache file type " + strconv.Quote(dU.Type))
+	}
 
 	// Create new location
-	k := "fs_" + strconv.FormatInt(dU.Id, 16) + "_" + dU.Name
+	k := self.Namer.Key(dU)
 	l := FileStoreLocation{
 		Id:       "", // dummy driver doesn't have a store name/id
 		Driver:   self.DriverName(),
@@ -80,16 +175,33 @@ func (self *FSMemcache) Put(d FileStoreDescriptor, c []byte) (FileStoreDescripto
 	}
 
 	// Push out to filesystem
-	err := self.conn.Set(&memcache.Item{Key: k, Value: c})
+	expires := dU.Expires
+	if expires.IsZero() && self.Expiration > 0 {
+		expires = time.Now().Add(self.Expiration)
+	}
+	i := &memcache.Item{
+		Key:        k,
+		Expiration: memcacheExpiration(expires),
+	}
+	i.Value, i.Flags = memcacheEncode(dU.Type, expires, c)
+	var cas uint64
+	for _, v := range dU.Location {
+		if v.Key() == l.Key() {
+			var err error
+			cas, err = self.expectedCas(v)
+			if err != nil {
+				return dU, memcacheError(err)
+			}
+		}
+	}
+	err := self.store(i, cas)
 	if err != nil {
-		return dU, err
+		return dU, memcacheError(err)
 	}
+	l = withChecksum(l, i.Value)
 
 	// Append location
-	if dU.Location == nil {
-		dU.Location = make([]FileStoreLocation, 0)
-	}
-	dU.Location = append(dU.Location, l)
+	dU = AddLocation(dU, l)
 
 	// No errors, send back
 	return dU, nil
@@ -98,8 +210,8 @@ func (self *FSMemcache) Put(d FileStoreDescriptor, c []byte) (FileStoreDescripto
 func (self *FSMemcache) Delete(d FileStoreDescriptor, l FileStoreLocation) (FileStoreDescriptor, error) {
 	dU := d
 
-	// Find the pertinent FileStoreLocation
-	l, err := LocationForDriver(dU, self.DriverName())
+	// Find the pertinent FileStoreLocation, if we weren't given one
+	l, err := driverLocation(dU, l, self.DriverName())
 	if err != nil {
 		return dU, err
 	}
@@ -107,12 +219,188 @@ func (self *FSMemcache) Delete(d FileStoreDescriptor, l FileStoreLocation) (File
 	// Delete from disk
 	err = self.conn.Delete(l.Location)
 	if err != nil {
-		return dU, err
+		return dU, memcacheError(err)
 	}
 
 	// Remove from mapping
-	RemoveLocation(dU, l)
+	dU = RemoveLocation(dU, l)
 
 	// No errors, send back
 	return dU, nil
 }
+
+func (self *FSMemcache) Trash(l FileStoreLocation) (FileStoreLocation, error) {
+	lU := l
+	lU.Location = trashPrefix + l.Location
+
+	i, err := self.move(l.Location, lU.Location)
+	if err != nil {
+		return l, err
+	}
+
+	return withChecksum(lU, i.Value), nil
+}
+
+func (self *FSMemcache) Restore(l FileStoreLocation) (FileStoreLocation, error) {
+	lU := l
+	lU.Location = strings.TrimPrefix(l.Location, trashPrefix)
+
+	i, err := self.move(l.Location, lU.Location)
+	if err != nil {
+		return l, err
+	}
+
+	return withChecksum(lU, i.Value), nil
+}
+
+func (self *FSMemcache) Purge(l FileStoreLocation) error {
+	return memcacheError(self.conn.Delete(l.Location))
+}
+
+// store writes an item, replacing the version with the given CAS id if it
+// is set. Since an expired or deleted item can't conflict, a replacement
+// which finds nothing falls back to adding the item.
+func (self *FSMemcache) store(i *memcache.Item, cas uint64) error {
+	if cas != 0 {
+		i.CasID = cas
+		err := self.conn.CompareAndSwap(i)
+		if err != memcache.ErrCacheMiss {
+			return err
+		}
+	}
+	return self.conn.Add(i)
+}
+
+// expectedCas returns the CAS id an overwrite of a location must match,
+// or zero if nothing is stored there. Since memcache doesn't return the id
+// on writes, it is read from the current item, which must still hold the
+// value last written to the location.
+func (self *FSMemcache) expectedCas(l FileStoreLocation) (uint64, error) {
+	if v, exists := l.Options[memcacheOptionCas]; exists {
+		cas, _ := strconv.ParseUint(v, 10, 64)
+		return cas, nil
+	}
+	sum, exists := l.Options[memcacheOptionChecksum]
+	if !exists {
+		return 0, nil
+	}
+	i, err := self.conn.Get(l.Location)
+	if err == memcache.ErrCacheMiss {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if memcacheChecksum(i.Value) != sum {
+		return 0, ErrConflict
+	}
+	return i.CasID, nil
+}
+
+// withChecksum records the checksum of a freshly written value in the
+// options of its location.
+func withChecksum(l FileStoreLocation, v []byte) FileStoreLocation {
+	o := make(map[string]string, len(l.Options)+1)
+	for k, v := range l.Options {
+		o[k] = v
+	}
+	delete(o, memcacheOptionCas)
+	o[memcacheOptionChecksum] = memcacheChecksum(v)
+	l.Options = o
+	return l
+}
+
+// memcacheChecksum identifies an item value.
+func memcacheChecksum(v []byte) string {
+	h := sha256.Sum256(v)
+	return hex.EncodeToString(h[:8])
+}
+
+// move relocates a value from one key to another, since memcache has no
+// native rename, keeping its expiry, and returns the item written. It fails
+// with ErrConflict if the destination exists.
+func (self *FSMemcache) move(from, to string) (*memcache.Item, error) {
+	i, err := self.conn.Get(from)
+	if err != nil {
+		return nil, memcacheError(err)
+	}
+	_, _, expires, err := memcacheDecode(i)
+	if err != nil {
+		return nil, err
+	}
+	moved := &memcache.Item{Key: to, Value: i.Value, Flags: i.Flags, Expiration: memcacheExpiration(expires)}
+	err = self.conn.Add(moved)
+	if err != nil {
+		return nil, memcacheError(err)
+	}
+	return moved, memcacheError(self.conn.Delete(from))
+}
+
+// memcacheError maps memcache errors onto the errors returned by drivers.
+func memcacheError(err error) error {
+	switch err {
+	case memcache.ErrCacheMiss:
+		return ErrNotFound
+	case memcache.ErrNotStored, memcache.ErrCASConflict:
+		return ErrConflict
+	}
+	return err
+}
+
+// memcacheEncode prefixes file data with the header line, returning the
+// value and the flags describing it.
+func memcacheEncode(t string, expires time.Time, c []byte) ([]byte, uint32) {
+	var flags uint32 = memcacheFlagHeader
+	h := strconv.Itoa(len(c)) + " "
+	if !expires.IsZero() {
+		flags |= memcacheFlagExpires
+		h += strconv.FormatInt(expires.Unix(), 10) + " "
+	}
+	h += t + "\n"
+	v := make([]byte, 0, len(h)+len(c))
+	return append(append(v, h...), c...), flags
+}
+
+// memcacheDecode splits an item into file data, type and expiry.
+func memcacheDecode(i *memcache.Item) ([]byte, string, time.Time, error) {
+	if i.Flags&memcacheFlagHeader == 0 {
+		return i.Value, "", time.Time{}, nil
+	}
+	malformed := errors.New("Malformed memcache item " + i.Key)
+	n := bytes.IndexByte(i.Value, '\n')
+	if n < 0 {
+		return nil, "", time.Time{}, malformed
+	}
+	fields := 2
+	if i.Flags&memcacheFlagExpires != 0 {
+		fields = 3
+	}
+	h := strings.SplitN(string(i.Value[:n]), " ", fields)
+	c := i.Value[n+1:]
+	size, err := strconv.Atoi(h[0])
+	if err != nil || size != len(c) || len(h) != fields {
+		return nil, "", time.Time{}, malformed
+	}
+	var expires time.Time
+	if fields == 3 {
+		s, err := strconv.ParseInt(h[1], 10, 64)
+		if err != nil {
+			return nil, "", time.Time{}, malformed
+		}
+		expires = time.Unix(s, 0)
+	}
+	return c, h[fields-1], expires, nil
+}
+
+// memcacheExpiration converts an expiry time to the memcache representation,
+// which is relative seconds for up to 30 days and a unix time beyond that.
+func memcacheExpiration(t time.Time) int32 {
+	if t.IsZero() {
+		return 0
+	}
+	s := expirySeconds(t)
+	if s > 30*24*60*60 {
+		return int32(t.Unix())
+	}
+	return int32(s)
+}
@@ -0,0 +1,246 @@
+package fsabstract
+
+import (
+	"bufio"
+	memcache "github.com/bradfitz/gomemcache/memcache"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemcacheEncoding(t *testing.T) {
+	i := &memcache.Item{Key: "k"}
+	i.Value, i.Flags = memcacheEncode("text/plain; charset=utf-8", time.Time{}, []byte("a\nb"))
+	c, ty, expires, err := memcacheDecode(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(c) != "a\nb" || ty != "text/plain; charset=utf-8" || !expires.IsZero() || i.Flags != memcacheFlagHeader {
+		t.Errorf("Decoded %q as %s, expiring %v", c, ty, expires)
+	}
+
+	// Truncated values are rejected
+	i.Value = i.Value[:len(i.Value)-1]
+	if _, _, _, err = memcacheDecode(i); err == nil {
+		t.Error("Expected truncated item to be rejected")
+	}
+
+	// The expiry is kept in the header
+	e := time.Unix(1700000000, 0)
+	i.Value, i.Flags = memcacheEncode("text/plain", e, []byte("data"))
+	if c, ty, expires, err = memcacheDecode(i); err != nil || string(c) != "data" || ty != "text/plain" || !expires.Equal(e) {
+		t.Errorf("Decoded %q as %s, expiring %v, %v", c, ty, expires, err)
+	}
+
+	// Items without the header flag are returned as is
+	i = &memcache.Item{Key: "k", Value: []byte("raw")}
+	if c, _, _, err = memcacheDecode(i); err != nil || string(c) != "raw" {
+		t.Errorf("Decoded %q, %v", c, err)
+	}
+
+	if memcacheError(memcache.ErrCacheMiss) != ErrNotFound || memcacheError(memcache.ErrCASConflict) != ErrConflict {
+		t.Error("Memcache errors not mapped")
+	}
+}
+
+// fakeMemcache is an in-process memcached, supporting just the text
+// protocol commands used by the driver.
+type fakeMemcache struct {
+	lock  sync.Mutex
+	items map[string]fakeMemcacheItem
+	cas   uint64
+	gets  int
+}
+
+type fakeMemcacheItem struct {
+	flags   string
+	exptime string
+	data    []byte
+	cas     uint64
+}
+
+func newFakeMemcache(t *testing.T) (string, *fakeMemcache) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	f := &fakeMemcache{items: map[string]fakeMemcacheItem{}}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return ln.Addr().String(), f
+}
+
+func (self *fakeMemcache) item(k string) (fakeMemcacheItem, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	i, exists := self.items[k]
+	return i, exists
+}
+
+// reads returns the number of retrievals served.
+func (self *fakeMemcache) reads() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.gets
+}
+
+func (self *fakeMemcache) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) < 2 {
+			return
+		}
+		var data []byte
+		if args[0] == "add" || args[0] == "cas" {
+			n, _ := strconv.Atoi(args[4])
+			data = make([]byte, n+2)
+			if _, err = io.ReadFull(r, data); err != nil {
+				return
+			}
+			data = data[:n]
+		}
+
+		self.lock.Lock()
+		i, exists := self.items[args[1]]
+		reply := ""
+		switch args[0] {
+		case "gets":
+			self.gets++
+			for _, k := range args[1:] {
+				if i, exists := self.items[k]; exists {
+					reply += "VALUE " + k + " " + i.flags + " " + strconv.Itoa(len(i.data)) + " " + strconv.FormatUint(i.cas, 10) + "\r\n" + string(i.data) + "\r\n"
+				}
+			}
+			reply += "END\r\n"
+		case "add", "cas":
+			if args[0] == "add" && exists {
+				reply = "NOT_STORED\r\n"
+			} else if args[0] == "cas" && !exists {
+				reply = "NOT_FOUND\r\n"
+			} else if args[0] == "cas" && strconv.FormatUint(i.cas, 10) != args[5] {
+				reply = "EXISTS\r\n"
+			} else {
+				self.cas++
+				self.items[args[1]] = fakeMemcacheItem{flags: args[2], exptime: args[3], data: data, cas: self.cas}
+				reply = "STORED\r\n"
+			}
+		case "delete":
+			reply = "NOT_FOUND\r\n"
+			if exists {
+				delete(self.items, args[1])
+				reply = "DELETED\r\n"
+			}
+		default:
+			reply = "ERROR\r\n"
+		}
+		self.lock.Unlock()
+		c.Write([]byte(reply))
+	}
+}
+
+func TestMemcacheDriverLocations(t *testing.T) {
+	addr, _ := newFakeMemcache(t)
+	d := new(FSMemcache)
+	d.Configure(map[string]string{"fs.memcache.servers": addr})
+	if err := d.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	testDriverLocations(t, d)
+}
+
+func TestMemcacheDriverCas(t *testing.T) {
+	addr, f := newFakeMemcache(t)
+	d := new(FSMemcache)
+	d.Configure(map[string]string{"fs.memcache.servers": addr})
+	if err := d.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := d.Put(FileStoreDescriptor{Id: 1}, []byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Location[0].Options[memcacheOptionChecksum] == "" {
+		t.Fatalf("Put recorded no checksum in %v", first.Location)
+	}
+	if n := f.reads(); n != 0 {
+		t.Errorf("Put of a new item read %d times", n)
+	}
+
+	// Overwrites need the current CAS id
+	second, err := d.Put(first, []byte("two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.Put(first, []byte("stale")); err != ErrConflict {
+		t.Errorf("Put with a stale CAS id returned %v", err)
+	}
+	if _, err = d.Put(FileStoreDescriptor{Id: 1}, []byte("blind")); err != ErrConflict {
+		t.Errorf("Put over an unknown item returned %v", err)
+	}
+	if c, _, _ := d.Get(second); string(c) != "two" {
+		t.Errorf("Get returned %q", c)
+	}
+
+	// Locations holding a CAS id are still honoured
+	legacy := second
+	legacy.Location = []FileStoreLocation{second.Location[0]}
+	legacy.Location[0].Options = map[string]string{memcacheOptionCas: "1"}
+	if _, err = d.Put(legacy, []byte("stale")); err != ErrConflict {
+		t.Errorf("Put with a stale recorded CAS id returned %v", err)
+	}
+
+	// Line breaks in the type would corrupt the header
+	if _, err = d.Put(FileStoreDescriptor{Id: 3, Type: "text/plain\n1 x"}, []byte("x")); err == nil {
+		t.Error("Put accepted a type with a line break")
+	}
+
+	// A CAS id for an item which has gone away doesn't prevent writing
+	d.Purge(second.Location[0])
+	if _, err = d.Put(second, []byte("three")); err != nil {
+		t.Errorf("Put after the item was removed returned %v", err)
+	}
+
+	t.Log("Expiry is kept by Trash and Restore")
+	fsd, err := d.Put(FileStoreDescriptor{Id: 2, Expires: time.Now().Add(time.Hour)}, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl, err := d.Trash(fsd.Location[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i, _ := f.item(tl.Location); i.exptime == "" || i.exptime == "0" {
+		t.Errorf("Trashed item expires at %q", i.exptime)
+	}
+	rl, err := d.Restore(tl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i, _ := f.item(rl.Location); i.exptime == "" || i.exptime == "0" {
+		t.Errorf("Restored item expires at %q", i.exptime)
+	}
+	fsd = AddLocation(fsd, rl)
+	if _, err = d.Put(fsd, []byte("replaced")); err != nil {
+		t.Errorf("Put after Restore returned %v", err)
+	}
+}
@@ -0,0 +1,587 @@
+package fsabstract
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	MULTILOCAL_PLACEMENT_FREE = "free"
+	MULTILOCAL_PLACEMENT_HASH = "hash"
+
+	// multiLocalMarker names the file identifying each root, which is
+	// missing from the empty mountpoint left by an unmounted disk.
+	multiLocalMarker = ".multilocal"
+)
+
+func init() {
+	FileStoreDriverMap["multilocal"] = func() FileStoreDriver {
+		return new(FSMultiLocal)
+	}
+}
+
+// FSMultiLocal is a local filesystem driver which spreads files across
+// several roots, such as separately mounted disks. Each root is a local
+// store, configured by the fs.local.* keys other than the basepath, and
+// recorded as the Id of the locations it holds.
+//
+// Roots are listed as "<path>[=<weight>]". New files go to the root with
+// the most space available with the "free" placement (the default), or to
+// the highest ranked root for the file Id with the "hash" placement, which
+// uses weighted rendezvous hashing so that adding a root only moves the
+// files which now belong to it. Roots which are full or unavailable are
+// passed over; those unavailable when the driver is initialized stay so
+// until it is initialized again. Each root is identified by a marker file
+// recording its StoreId, and is unavailable whenever that file is missing,
+// replaced or names another root, as with the empty mountpoint left by an
+// unmounted disk. Markers are only created with CreateRoots set, for roots
+// which are empty or don't exist yet. Replicas copies of each file are kept on
+// distinct roots, and reads are served from any root still available.
+//
+// Rebalance moves files whose root no longer matches the placement, or, for
+// the "free" placement, to a root with more space, after roots are added or
+// reweighted.
+type FSMultiLocal struct {
+	Roots     string `fsdconfig:"fs.multilocal.roots"`
+	Placement string `fsdconfig:"fs.multilocal.placement"`
+	Replicas  int    `fsdconfig:"fs.multilocal.replicas"`
+
+	CreateRoots bool `fsdconfig:"fs.multilocal.createRoots"`
+
+	options map[string]string // fs.local.* keys, for each root
+	roots   []*multiLocalRoot
+}
+
+// multiLocalRoot is one of the stores of an FSMultiLocal.
+type multiLocalRoot struct {
+	*FSLocal
+	weight float64
+	marker os.FileInfo // of the identity marker, once initialized
+	err    error       // from Initialize, if the root is unavailable
+}
+
+func (self *FSMultiLocal) DriverName() string {
+	return "multilocal"
+}
+
+func (self *FSMultiLocal) Configure(c map[string]string) {
+	if v, exists := c["fs.multilocal.roots"]; exists {
+		if _, err := parseMultiLocalRoots(v); err != nil {
+			panic(err.Error())
+		}
+		self.Roots = v
+	}
+	if v, exists := c["fs.multilocal.placement"]; exists {
+		if v != MULTILOCAL_PLACEMENT_FREE && v != MULTILOCAL_PLACEMENT_HASH {
+			panic("Unknown multilocal placement " + v)
+		}
+		self.Placement = v
+	}
+	if v, exists := c["fs.multilocal.replicas"]; exists {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			panic("Unable to use replica count " + v)
+		}
+		self.Replicas = n
+	}
+	if v, exists := c["fs.multilocal.createRoots"]; exists {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			panic("Unable to parse create roots flag " + v)
+		}
+		self.CreateRoots = b
+	}
+
+	// Options for each root, checked now so that bad values panic here
+	options := make(map[string]string)
+	for k, v := range c {
+		if strings.HasPrefix(k, "fs.local.") && k != "fs.local.basepath" && k != "fs.local.storeId" {
+			options[k] = v
+		}
+	}
+	new(FSLocal).Configure(options)
+	if self.options == nil {
+		self.options = make(map[string]string)
+	}
+	for k, v := range options {
+		self.options[k] = v
+	}
+}
+
+func (self *FSMultiLocal) Initialize() error {
+	if self.Placement == "" {
+		self.Placement = MULTILOCAL_PLACEMENT_FREE
+	}
+	if self.Replicas == 0 {
+		self.Replicas = 1
+	}
+	weights, err := parseMultiLocalRoots(self.Roots)
+	if err != nil {
+		return err
+	}
+	if len(weights) == 0 {
+		return errors.New("No multilocal roots configured")
+	}
+
+	// An unavailable root doesn't prevent using the others
+	self.roots = make([]*multiLocalRoot, 0, len(weights))
+	seen := make(map[string]bool)
+	available := 0
+	for _, w := range weights {
+		r := &multiLocalRoot{FSLocal: &FSLocal{driver: self.DriverName()}, weight: w.weight}
+		r.Configure(self.options)
+		r.Configure(map[string]string{"fs.local.basepath": w.path})
+		r.marker, r.err = r.identify(self.CreateRoots)
+		if r.err != nil {
+			log.Print("Multilocal root " + w.path + " unavailable : " + r.err.Error())
+			abs, err := filepath.Abs(w.path)
+			if err != nil {
+				return err
+			}
+			r.StoreId = abs
+		} else {
+			available++
+		}
+		if seen[r.StoreId] {
+			return errors.New("Duplicate multilocal root " + w.path)
+		}
+		seen[r.StoreId] = true
+		self.roots = append(self.roots, r)
+	}
+	if available == 0 {
+		return errors.New("No multilocal roots available")
+	}
+	return nil
+}
+
+// Close stops the background sweepers of the roots, if they are running.
+func (self *FSMultiLocal) Close() error {
+	for _, r := range self.roots {
+		r.Close()
+	}
+	return nil
+}
+
+func (self *FSMultiLocal) Get(d FileStoreDescriptor) ([]byte, FileStoreLocation, error) {
+	ls := LocationsForDriver(d, self.DriverName())
+	if len(ls) == 0 {
+		return nil, FileStoreLocation{}, errors.New("Driver " + self.DriverName() + " not found : " + d.ToString())
+	}
+	if d.Expired() {
+		return nil, FileStoreLocation{}, ErrNotFound
+	}
+
+	// Fall back to the replicas if a root fails
+	var err error
+	for _, l := range ls {
+		var c []byte
+		c, err = self.GetFrom(d, l)
+		if err == nil {
+			return c, l, nil
+		}
+	}
+	return nil, ls[0], err
+}
+
+// GetFrom retrieves the file data at a specific location of a descriptor.
+func (self *FSMultiLocal) GetFrom(d FileStoreDescriptor, l FileStoreLocation) ([]byte, error) {
+	r, err := self.rootFor(l)
+	if err != nil {
+		return nil, err
+	}
+	return r.GetFrom(d, l)
+}
+
+func (self *FSMultiLocal) Put(d FileStoreDescriptor, c []byte) (FileStoreDescriptor, error) {
+	return self.put(d, func(r *FSLocal) (FileStoreDescriptor, error) {
+		return r.Put(d, c)
+	})
+}
+
+func (self *FSMultiLocal) PutReader(d FileStoreDescriptor, r io.Reader) (FileStoreDescriptor, error) {
+	cr := &countingReader{Reader: r}
+	return self.put(d, func(r *FSLocal) (FileStoreDescriptor, error) {
+		if cr.N > 0 {
+			// Already partly consumed by a failed attempt
+			return d, errors.New("Unable to retry streamed write")
+		}
+		return r.PutReader(d, cr)
+	})
+}
+
+// put stores file data on the first root which accepts it, in placement
+// order, then replicates it to the following ones.
+func (self *FSMultiLocal) put(d FileStoreDescriptor, write func(*FSLocal) (FileStoreDescriptor, error)) (FileStoreDescriptor, error) {
+	roots := self.candidates(d, nil)
+	if len(roots) == 0 {
+		return d, errors.New("No multilocal roots available")
+	}
+
+	var dU FileStoreDescriptor
+	var from *multiLocalRoot
+	var err error
+	for len(roots) > 0 && from == nil {
+		dU, err = write(roots[0].FSLocal)
+		if err == nil {
+			from = roots[0]
+		}
+		roots = roots[1:]
+	}
+	if err != nil {
+		return d, err
+	}
+	primary := dU.Location[len(dU.Location)-1]
+
+	// Replicas are best effort
+	copies := 1
+	for _, r := range roots {
+		if copies >= self.Replicas {
+			break
+		}
+		rU, err := from.Replicate(dU, primary, r.FSLocal)
+		if err != nil {
+			log.Print("Unable to replicate " + primary.Location + " to " + r.StoreId + " : " + err.Error())
+			continue
+		}
+		dU = rU
+		copies++
+	}
+	return dU, nil
+}
+
+// Delete removes the file data at a location. Without a location, every
+// copy held by the driver is removed.
+func (self *FSMultiLocal) Delete(d FileStoreDescriptor, l FileStoreLocation) (FileStoreDescriptor, error) {
+	dU := d
+	ls := []FileStoreLocation{l}
+	if l.Driver == "" && l.Location == "" {
+		ls = LocationsForDriver(d, self.DriverName())
+		if len(ls) == 0 {
+			return dU, errors.New("Driver " + self.DriverName() + " not found : " + d.ToString())
+		}
+	}
+	for _, v := range ls {
+		r, err := self.rootFor(v)
+		if err != nil {
+			return dU, err
+		}
+		dU, err = r.Delete(dU, v)
+		if err != nil {
+			return dU, err
+		}
+	}
+	return dU, nil
+}
+
+func (self *FSMultiLocal) Trash(l FileStoreLocation) (FileStoreLocation, error) {
+	r, err := self.rootFor(l)
+	if err != nil {
+		return l, err
+	}
+	return r.Trash(l)
+}
+
+func (self *FSMultiLocal) Restore(l FileStoreLocation) (FileStoreLocation, error) {
+	r, err := self.rootFor(l)
+	if err != nil {
+		return l, err
+	}
+	return r.Restore(l)
+}
+
+func (self *FSMultiLocal) Purge(l FileStoreLocation) error {
+	r, err := self.rootFor(l)
+	if err != nil {
+		return err
+	}
+	return r.Purge(l)
+}
+
+// Rebalance moves the copies of a descriptor to the roots the placement
+// now prefers, returning the updated descriptor. Copies on unavailable
+// roots are left alone. Each old copy is removed as soon as its new one is
+// made, so the descriptor must be saved afterwards; RebalanceCatalog only
+// removes it once the catalog records the move.
+func (self *FSMultiLocal) Rebalance(d FileStoreDescriptor) (FileStoreDescriptor, error) {
+	dU, _, err := self.rebalance(d, func(dU FileStoreDescriptor, from, to FileStoreLocation) (FileStoreDescriptor, error) {
+		return RemoveLocation(AddLocation(dU, to), from), nil
+	})
+	return dU, err
+}
+
+// RebalanceCatalog rebalances every descriptor in a catalog, and returns
+// the number of copies moved. Each move is made by copying the file data,
+// recording the new location in place of the old one with
+// UpdateDescriptor, then removing the old copy, so the catalog never refers
+// to missing data. Descriptors which fail to move are logged and skipped;
+// the last such error is returned.
+func (self *FSMultiLocal) RebalanceCatalog(c DescriptorStore) (int, error) {
+	ds, err := c.Query(DescriptorQuery{})
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, d := range ds {
+		_, n, rerr := self.rebalance(d, func(dU FileStoreDescriptor, from, to FileStoreLocation) (FileStoreDescriptor, error) {
+			var dC FileStoreDescriptor
+			err := UpdateDescriptor(c, dU.Id, func(s FileStoreDescriptor) (FileStoreDescriptor, error) {
+				for _, v := range s.Location {
+					if v.Key() == from.Key() {
+						dC = RemoveLocation(AddLocation(s, to), from)
+						return dC, nil
+					}
+				}
+				return s, ErrConflict
+			})
+			return dC, err
+		})
+		moved += n
+		if rerr != nil {
+			log.Print("Rebalance failed for " + strconv.FormatInt(d.Id, 10) + " : " + rerr.Error())
+			err = rerr
+		}
+	}
+	return moved, err
+}
+
+// rebalance moves each copy of a descriptor which belongs elsewhere,
+// calling commit to record the new location in place of the old one before
+// the old copy is removed. A copy whose move can't be committed is removed
+// from its new root instead.
+func (self *FSMultiLocal) rebalance(d FileStoreDescriptor, commit func(FileStoreDescriptor, FileStoreLocation, FileStoreLocation) (FileStoreDescriptor, error)) (FileStoreDescriptor, int, error) {
+	dU := d
+	held := make(map[string]bool)
+	ls := LocationsForDriver(d, self.DriverName())
+	for _, l := range ls {
+		held[l.Id] = true
+	}
+
+	moved := 0
+	for _, l := range ls {
+		from, err := self.rootFor(l)
+		if err != nil {
+			continue
+		}
+		to, err := self.target(d, l, from, held)
+		if err != nil {
+			return dU, moved, err
+		}
+		if to == nil {
+			continue
+		}
+		dR, err := from.Replicate(dU, l, to.FSLocal)
+		if err != nil {
+			return dU, moved, err
+		}
+		nl := dR.Location[len(dR.Location)-1]
+		dC, err := commit(dU, l, nl)
+		if err != nil {
+			if rerr := to.remove(nl); rerr != nil {
+				log.Print("Unable to remove uncommitted copy " + nl.ToString() + " : " + rerr.Error())
+			}
+			return dU, moved, err
+		}
+		dU = dC
+		delete(held, l.Id)
+		held[to.StoreId] = true
+		moved++
+		err = from.remove(l)
+		if err != nil {
+			return dU, moved, err
+		}
+	}
+	return dU, moved, nil
+}
+
+// target returns the root a copy at l should move to, or nil if it is
+// where it belongs.
+func (self *FSMultiLocal) target(d FileStoreDescriptor, l FileStoreLocation, from *multiLocalRoot, held map[string]bool) (*multiLocalRoot, error) {
+	if self.Placement == MULTILOCAL_PLACEMENT_HASH {
+		preferred := self.ranked(d)
+		if len(preferred) > self.Replicas {
+			preferred = preferred[:self.Replicas]
+		}
+		for _, r := range preferred {
+			if r == from {
+				return nil, nil
+			}
+		}
+		for _, r := range preferred {
+			if !held[r.StoreId] && r.online() {
+				return r, nil
+			}
+		}
+		return nil, nil
+	}
+
+	// Only move if the roots end up closer to even
+	roots := self.candidates(d, held)
+	if len(roots) == 0 {
+		return nil, nil
+	}
+	p, err := from.locate(l)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	have, _, err := from.space()
+	if err != nil || have < 0 {
+		return nil, err
+	}
+	want, _, err := roots[0].space()
+	if err != nil || want < 0 {
+		return nil, err
+	}
+	if want-info.Size() < have+info.Size() {
+		return nil, nil
+	}
+	return roots[0], nil
+}
+
+// rootFor returns the available root holding a location.
+func (self *FSMultiLocal) rootFor(l FileStoreLocation) (*multiLocalRoot, error) {
+	err := checkLocation(l, self.DriverName())
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range self.roots {
+		if r.StoreId == l.Id {
+			if !r.online() {
+				return nil, errors.New("Multilocal root " + r.StoreId + " unavailable")
+			}
+			return r, nil
+		}
+	}
+	return nil, errors.New("Multilocal root " + l.Id + " not configured : " + l.ToString())
+}
+
+// ranked returns every root, by decreasing rendezvous hash score for a
+// descriptor.
+func (self *FSMultiLocal) ranked(d FileStoreDescriptor) []*multiLocalRoot {
+	roots := make([]*multiLocalRoot, len(self.roots))
+	copy(roots, self.roots)
+	sort.SliceStable(roots, func(i, j int) bool {
+		return roots[i].score(d) > roots[j].score(d)
+	})
+	return roots
+}
+
+// candidates returns the available roots not in exclude, in the order in
+// which they should receive a new file.
+func (self *FSMultiLocal) candidates(d FileStoreDescriptor, exclude map[string]bool) []*multiLocalRoot {
+	roots := make([]*multiLocalRoot, 0, len(self.roots))
+	free := make(map[*multiLocalRoot]int64)
+	for _, r := range self.ranked(d) {
+		if exclude[r.StoreId] || !r.online() {
+			continue
+		}
+		roots = append(roots, r)
+		if available, _, err := r.space(); err == nil && available >= 0 {
+			free[r] = available
+		} else {
+			free[r] = math.MaxInt64
+		}
+	}
+	if self.Placement == MULTILOCAL_PLACEMENT_FREE {
+		sort.SliceStable(roots, func(i, j int) bool {
+			return free[roots[i]] > free[roots[j]]
+		})
+	}
+	return roots
+}
+
+// identify initializes the root and returns its identity marker. Without
+// create, a root lacking a marker is refused before anything is written to
+// it; otherwise the marker is created, as long as the root is empty.
+func (self *multiLocalRoot) identify(create bool) (os.FileInfo, error) {
+	p := filepath.Join(self.BasePath, multiLocalMarker)
+	_, err := os.Stat(p)
+	if os.IsNotExist(err) && !create {
+		return nil, errors.New("No multilocal marker in " + self.BasePath + ", set fs.multilocal.createRoots to create it")
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	err = self.Initialize()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		entries, err := ioutil.ReadDir(self.BasePath)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			return nil, errors.New("Unable to create multilocal marker in non-empty " + self.BasePath)
+		}
+		c = []byte(self.StoreId + "\n")
+		_, err = writeFileAtomic(p, bytes.NewReader(c), self.FileMode, self.DirMode, nil)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if id := strings.TrimSpace(string(c)); id != self.StoreId {
+		return nil, errors.New("Multilocal marker in " + self.BasePath + " is for " + id)
+	}
+	return os.Stat(p)
+}
+
+// online determines whether the root can currently be used, which is as
+// long as it still holds the identity marker found when it was initialized.
+func (self *multiLocalRoot) online() bool {
+	if self.err != nil {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(self.BasePath, multiLocalMarker))
+	return err == nil && os.SameFile(info, self.marker)
+}
+
+// score is the weighted rendezvous hash score of the root for a descriptor.
+func (self *multiLocalRoot) score(d FileStoreDescriptor) float64 {
+	sum := sha256.Sum256([]byte(self.StoreId + "/" + strconv.FormatInt(d.Id, 16)))
+	u := (float64(binary.BigEndian.Uint64(sum[:8])>>11) + 0.5) / (1 << 53)
+	return self.weight / -math.Log(u)
+}
+
+type multiLocalWeight struct {
+	path   string
+	weight float64
+}
+
+// parseMultiLocalRoots parses a list of "<path>[=<weight>]" roots.
+func parseMultiLocalRoots(v string) ([]multiLocalWeight, error) {
+	roots := make([]multiLocalWeight, 0)
+	for _, root := range splitList(v) {
+		w := multiLocalWeight{path: root, weight: 1}
+		if i := strings.LastIndex(root, "="); i >= 0 {
+			n, err := strconv.ParseFloat(root[i+1:], 64)
+			if err != nil || n <= 0 || math.IsInf(n, 0) {
+				return nil, errors.New("Unable to parse weight of multilocal root " + root)
+			}
+			w.path, w.weight = root[:i], n
+		}
+		if w.path == "" {
+			return nil, errors.New("No path for multilocal root " + root)
+		}
+		roots = append(roots, w)
+	}
+	return roots, nil
+}
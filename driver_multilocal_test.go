@@ -0,0 +1,214 @@
+package fsabstract
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testMultiLocalDriver(t *testing.T, dir string, roots []string, c map[string]string) *FSMultiLocal {
+	for k := range roots {
+		roots[k] = filepath.Join(dir, roots[k])
+	}
+	d := &FSMultiLocal{}
+	d.Configure(map[string]string{"fs.multilocal.roots": strings.Join(roots, ","), "fs.multilocal.createRoots": "true"})
+	d.Configure(c)
+	if err := d.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestMultiLocalDriver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsabstract-multilocal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A root which can't be created doesn't prevent using the others
+	if err = ioutil.WriteFile(filepath.Join(dir, "broken"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := testMultiLocalDriver(t, dir, []string{"a", "b", "broken/c"}, map[string]string{"fs.multilocal.replicas": "2", "fs.local.layout": "flat"})
+
+	fsd, err := d.Put(FileStoreDescriptor{Id: 1}, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fsd.Location) != 2 || fsd.Location[0].Id == fsd.Location[1].Id {
+		t.Fatalf("Put gave locations %v", fsd.Location)
+	}
+	for _, l := range fsd.Location {
+		if l.Driver != "multilocal" || (l.Id != d.roots[0].StoreId && l.Id != d.roots[1].StoreId) {
+			t.Errorf("Stored at %v", l)
+		}
+	}
+
+	// Reads carry on from the replica when a root goes away, leaving an
+	// empty directory as an unmounted disk does
+	first := fsd.Location[0].Id
+	if err = os.Rename(first, first+".offline"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(first, 0700); err != nil {
+		t.Fatal(err)
+	}
+	c, l, err := d.Get(fsd)
+	if err != nil || string(c) != "data" || l.Id == first {
+		t.Errorf("Get with a root unavailable returned %q from %v, %v", c, l, err)
+	}
+	if _, err = d.GetFrom(fsd, fsd.Location[0]); err == nil {
+		t.Error("GetFrom an unavailable root succeeded")
+	}
+	fsd, err = d.Put(FileStoreDescriptor{Id: 2}, []byte("data"))
+	if err != nil || len(fsd.Location) != 1 || fsd.Location[0].Id == first {
+		t.Errorf("Put with a root unavailable gave %v, %v", fsd.Location, err)
+	}
+	if err = os.Remove(first); err != nil {
+		t.Errorf("Root left in use while unavailable : %v", err)
+	}
+
+	// A restart doesn't take up the empty directory either, or a directory
+	// marked for another root, unless asked to create new roots
+	if err = os.Mkdir(first, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Join(dir, "copied"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	other := d.roots[0]
+	if other.StoreId == first {
+		other = d.roots[1]
+	}
+	marker, _ := ioutil.ReadFile(filepath.Join(other.BasePath, multiLocalMarker))
+	if err = ioutil.WriteFile(filepath.Join(dir, "copied", multiLocalMarker), marker, 0600); err != nil {
+		t.Fatal(err)
+	}
+	r := testMultiLocalDriver(t, dir, []string{filepath.Base(first), filepath.Base(other.BasePath), "copied", "new"}, map[string]string{"fs.multilocal.createRoots": "false"})
+	for i, root := range r.roots {
+		if root.online() != (i == 1) {
+			t.Errorf("Root %s available : %v", root.BasePath, root.online())
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dir, "new")); !os.IsNotExist(err) {
+		t.Errorf("Unmarked root created : %v", err)
+	}
+	if err = os.Remove(first); err != nil {
+		t.Errorf("Unmarked root written to : %v", err)
+	}
+	if err = os.Mkdir(first, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(first, "file_1"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	r = testMultiLocalDriver(t, dir, []string{filepath.Base(first), filepath.Base(other.BasePath)}, nil)
+	if r.roots[0].online() {
+		t.Error("Marker created in a non-empty root")
+	}
+	if err = os.RemoveAll(first); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(first+".offline", first); err != nil {
+		t.Fatal(err)
+	}
+
+	d.Replicas = 1
+	testDriverLocations(t, d)
+}
+
+func TestMultiLocalDriverPlacement(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsabstract-multilocal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Free space placement fills the emptiest root
+	d := testMultiLocalDriver(t, dir, []string{"free1", "free2"}, map[string]string{"fs.local.quota": "100"})
+	fsd, err := d.Put(FileStoreDescriptor{Id: 1}, make([]byte, 60))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(2); i < 5; i++ {
+		fsdN, err := d.Put(FileStoreDescriptor{Id: i}, make([]byte, 10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fsdN.Location[0].Id == fsd.Location[0].Id {
+			t.Errorf("File %d stored on the fuller root", i)
+		}
+	}
+
+	// Weighted hash placement, which only moves files to new roots when
+	// rebalancing
+	c := new(DSMemory)
+	c.Initialize()
+	d = testMultiLocalDriver(t, dir, []string{"hash1", "hash2=3"}, map[string]string{"fs.multilocal.placement": "hash"})
+	counts := make(map[string]int)
+	for i := int64(1); i <= 200; i++ {
+		fsd, err := d.Put(FileStoreDescriptor{Id: i}, []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fsd.Location[0].Id != d.ranked(fsd)[0].StoreId {
+			t.Fatalf("File %d stored on %s", i, fsd.Location[0].Id)
+		}
+		counts[fsd.Location[0].Id]++
+		c.Save(fsd)
+	}
+	if counts[d.roots[1].StoreId] < 2*counts[d.roots[0].StoreId] {
+		t.Errorf("Weights ignored, stored %v", counts)
+	}
+
+	d = testMultiLocalDriver(t, dir, []string{"hash1", "hash2=3", "hash3=4"}, map[string]string{"fs.multilocal.placement": "hash"})
+
+	// Nothing is removed unless the catalog records the move
+	moved, err := d.RebalanceCatalog(failingSaveStore{c})
+	if err == nil || moved != 0 {
+		t.Fatalf("Rebalance with failing catalog moved %d, %v", moved, err)
+	}
+	ds, _ := c.Query(DescriptorQuery{})
+	for _, fsd := range ds {
+		if data, _, err := d.Get(fsd); err != nil || string(data) != "data" {
+			t.Fatalf("Get of %d after failed rebalance returned %q, %v", fsd.Id, data, err)
+		}
+	}
+	filepath.Walk(d.roots[2].BasePath, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() && filepath.Base(path) != multiLocalMarker {
+			t.Errorf("Uncommitted copy %s left", path)
+		}
+		return err
+	})
+
+	moved, err = d.RebalanceCatalog(c)
+	if err != nil || moved == 0 || moved > 150 {
+		t.Fatalf("Rebalance moved %d, %v", moved, err)
+	}
+	ds, _ = c.Query(DescriptorQuery{})
+	for _, fsd := range ds {
+		if len(fsd.Location) != 1 || fsd.Location[0].Id != d.ranked(fsd)[0].StoreId {
+			t.Fatalf("File %d left at %v", fsd.Id, fsd.Location)
+		}
+		if data, _, err := d.Get(fsd); err != nil || string(data) != "data" {
+			t.Fatalf("Get of %d after rebalance returned %q, %v", fsd.Id, data, err)
+		}
+	}
+	if moved, err = d.RebalanceCatalog(c); err != nil || moved != 0 {
+		t.Errorf("Second rebalance moved %d, %v", moved, err)
+	}
+}
+
+// failingSaveStore is a descriptor store which is unable to save.
+type failingSaveStore struct {
+	DescriptorStore
+}
+
+func (self failingSaveStore) Save(d FileStoreDescriptor) error {
+	return errors.New("Unable to save " + strconv.FormatInt(d.Id, 10))
+}
@@ -1,13 +1,41 @@
 package fsabstract
 
 import (
+	"bytes"
+	"context"
 	"errors"
-	"github.com/mitchellh/goamz/aws"
-	"github.com/mitchellh/goamz/s3"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	// DefaultS3Region is used when no region is configured or found in the
+	// environment, which is common for S3-compatible services.
+	DefaultS3Region = "us-east-1"
+
+	// s3MaxParts is the most parts a multipart upload may have.
+	s3MaxParts = 10000
+)
+
+var (
+	// s3MaxCopySize is the largest object which can be copied by a single
+	// CopyObject request; larger ones are copied in parts.
+	s3MaxCopySize int64 = 5 << 30
+)
+
 func init() {
 	FileStoreDriverMap["s3"] = func() FileStoreDriver {
 		return new(FSS3)
@@ -15,15 +43,75 @@ func init() {
 }
 
 // FSS3 is an AWS S3 driver.
+//
+// Requests are signed with Signature V4. Credentials are AccessKey,
+// SecretKey and SessionToken if set; otherwise they are found through the
+// standard AWS chain of environment variables, the shared credentials and
+// config files (using Profile, if set) and the instance or task role.
+//
+// Endpoint points the driver at an S3-compatible service, such as MinIO or
+// Ceph RGW, and PathStyle requests path-style addressing
+// (http://host/bucket/key), which most such services require. Optional
+// request and response checksums are only used against AWS itself, since
+// many S3-compatible services reject them.
+//
+// Objects larger than PartSize (at least 5 MiB) are sent as multipart
+// uploads, with up to Concurrency parts in flight at once. Each request,
+// including each part, is attempted up to Retries times, and the upload
+// is aborted if a part still fails, so that no incomplete upload is left
+// behind. PutReader streams from a reader, buffering at most Concurrency
+// parts in memory. Trash and Restore copy objects larger than 5 GiB, the
+// most a single copy accepts, in parts as well.
+//
+// New objects get the configured storage class, server side encryption
+// (SSE set to AES256 for SSE-S3, or aws:kms with SSEKMSKeyId for SSE-KMS),
+// canned ACL, Cache-Control and tags. If ContentDisposition is inline or
+// attachment, a Content-Disposition header carrying the descriptor Name is
+// added. Any of these can be overridden for a single file with a Metadata
+// entry using the same key as the configuration, for example
+// "fs.s3.storageClass", and the options chosen are recorded in the Options
+// of the FileStoreLocation.
+//
+// Each location records the bucket holding the object in its Id, and is
+// read from, trashed and deleted in that bucket, so a single driver can
+// serve several buckets. New objects go to BucketName unless one of the
+// Routes (see parseS3Routes) matches, for example
+// "type:image/*=images,hash:0-7=store-a,hash:8-f=store-b", or PutTo names
+// the bucket.
+//
+// Expiring objects are tagged with fsabstract-ttl=<days>d, rounded up to
+// whole days, so that a bucket lifecycle rule per tag value (for example,
+// "fsabstract-ttl=1d" expiring after 1 day) can remove them. The exact
+// expiry time is also recorded in the fsabstract-expires user metadata.
 type FSS3 struct {
-	BucketName string     `fsdconfig:"fs.s3.bucket"`
-	AccessKey  string     `fsdconfig:"fs.s3.accesskey"`
-	SecretKey  string     `fsdconfig:"fs.s3.secretkey"`
-	RegionObj  aws.Region `fsdconfig:"fs.s3.region"`
+	BucketName   string `fsdconfig:"fs.s3.bucket"`
+	AccessKey    string `fsdconfig:"fs.s3.accesskey"`
+	SecretKey    string `fsdconfig:"fs.s3.secretkey"`
+	SessionToken string `fsdconfig:"fs.s3.sessiontoken"`
+	Profile      string `fsdconfig:"fs.s3.profile"`
+	Region       string `fsdconfig:"fs.s3.region"`
+	Endpoint     string `fsdconfig:"fs.s3.endpoint"`
+	PathStyle    bool   `fsdconfig:"fs.s3.pathStyle"`
+	PartSize     int64  `fsdconfig:"fs.s3.partSize"`
+	Concurrency  int    `fsdconfig:"fs.s3.concurrency"`
+	Retries      int    `fsdconfig:"fs.s3.retries"`
 
-	auth   *aws.Auth
-	conn   *s3.S3
-	bucket *s3.Bucket
+	StorageClass       string `fsdconfig:"fs.s3.storageClass"`
+	SSE                string `fsdconfig:"fs.s3.sse"`
+	SSEKMSKeyId        string `fsdconfig:"fs.s3.sseKmsKeyId"`
+	ACL                string `fsdconfig:"fs.s3.acl"`
+	CacheControl       string `fsdconfig:"fs.s3.cacheControl"`
+	ContentDisposition string `fsdconfig:"fs.s3.contentDisposition"`
+	Tags               string `fsdconfig:"fs.s3.tags"`
+
+	Routes string `fsdconfig:"fs.s3.routes"`
+
+	KeyNaming string   `fsdconfig:"fs.s3.keyNaming"`
+	Namer     KeyNamer // populated by KeyNaming
+
+	routes   []s3Route
+	client   *s3.Client
+	uploader *manager.Uploader
 }
 
 func (self *FSS3) DriverName() string {
@@ -40,28 +128,155 @@ func (self *FSS3) Configure(c map[string]string) {
 	if v, exists := c["fs.s3.secretkey"]; exists {
 		self.SecretKey = v
 	}
+	if v, exists := c["fs.s3.sessiontoken"]; exists {
+		self.SessionToken = v
+	}
+	if v, exists := c["fs.s3.profile"]; exists {
+		self.Profile = v
+	}
 	if v, exists := c["fs.s3.region"]; exists {
-		if _, exists = aws.Regions[v]; exists {
-			self.RegionObj = aws.Regions[v]
-		} else {
-			panic("Unable to resolve S3 region " + v)
+		self.Region = v
+	}
+	if v, exists := c["fs.s3.endpoint"]; exists {
+		u, err := url.Parse(v)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			panic("Unable to parse S3 endpoint " + v)
+		}
+		self.Endpoint = v
+	}
+	if v, exists := c["fs.s3.pathStyle"]; exists {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			panic("Unable to parse S3 path style flag " + v)
+		}
+		self.PathStyle = b
+	}
+	if v, exists := c["fs.s3.partSize"]; exists {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < manager.MinUploadPartSize {
+			panic("Unable to use S3 part size " + v)
+		}
+		self.PartSize = n
+	}
+	if v, exists := c["fs.s3.concurrency"]; exists {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			panic("Unable to use S3 concurrency " + v)
+		}
+		self.Concurrency = n
+	}
+	if v, exists := c["fs.s3.retries"]; exists {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			panic("Unable to use S3 retries " + v)
 		}
+		self.Retries = n
 	}
+	if v, exists := c["fs.s3.storageClass"]; exists {
+		self.StorageClass = v
+	}
+	if v, exists := c["fs.s3.sse"]; exists {
+		self.SSE = v
+	}
+	if v, exists := c["fs.s3.sseKmsKeyId"]; exists {
+		self.SSEKMSKeyId = v
+	}
+	if v, exists := c["fs.s3.acl"]; exists {
+		self.ACL = v
+	}
+	if v, exists := c["fs.s3.cacheControl"]; exists {
+		self.CacheControl = v
+	}
+	if v, exists := c["fs.s3.contentDisposition"]; exists {
+		self.ContentDisposition = v
+	}
+	if v, exists := c["fs.s3.tags"]; exists {
+		self.Tags = v
+	}
+	err := validateS3Options(self.options())
+	if err != nil {
+		panic(err.Error())
+	}
+	if v, exists := c["fs.s3.routes"]; exists {
+		self.routes, err = parseS3Routes(v)
+		if err != nil {
+			panic(err.Error())
+		}
+		self.Routes = v
+	}
+	if v, exists := c["fs.s3.keyNaming"]; exists {
+		self.KeyNaming = v
+	}
+	n, err := newKeyNamer(self.KeyNaming, "fs.s3.", c)
+	if err != nil {
+		panic(err.Error())
+	}
+	self.Namer = n
 }
 
 func (self *FSS3) Initialize() error {
-	auth, err := aws.GetAuth(self.AccessKey, self.SecretKey)
+	if self.Namer == nil {
+		n, err := newKeyNamer(self.KeyNaming, "fs.s3.", nil)
+		if err != nil {
+			return err
+		}
+		self.Namer = n
+	}
+	if self.BucketName == "" {
+		return errors.New("No S3 bucket configured")
+	}
+	err := validateS3Options(self.options())
 	if err != nil {
 		return err
 	}
-	self.auth = &auth
-	conn := s3.New(*self.auth, self.RegionObj)
-	self.conn = conn
-	if self.conn == nil {
-		return errors.New("Unable to initialize s3 driver")
+	self.routes, err = parseS3Routes(self.Routes)
+	if err != nil {
+		return err
 	}
-	bucket := self.conn.Bucket(self.BucketName)
-	self.bucket = bucket
+	if self.PartSize == 0 {
+		self.PartSize = manager.DefaultUploadPartSize
+	}
+	if self.Concurrency == 0 {
+		self.Concurrency = manager.DefaultUploadConcurrency
+	}
+
+	opts := make([]func(*config.LoadOptions) error, 0)
+	if self.Region != "" {
+		opts = append(opts, config.WithRegion(self.Region))
+	}
+	if self.Profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(self.Profile))
+	}
+	if self.AccessKey != "" || self.SecretKey != "" {
+		opts = append(opts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(self.AccessKey, self.SecretKey, self.SessionToken)))
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return err
+	}
+	if cfg.Region == "" {
+		cfg.Region = DefaultS3Region
+	}
+
+	self.client = s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = self.PathStyle
+		if self.Retries > 0 {
+			o.RetryMaxAttempts = self.Retries
+		}
+		if self.Endpoint != "" {
+			o.BaseEndpoint = aws.String(self.Endpoint)
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+			o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+		}
+	})
+	self.uploader = manager.NewUploader(self.client, func(u *manager.Uploader) {
+		u.PartSize = self.PartSize
+		u.Concurrency = self.Concurrency
+		if self.Endpoint != "" {
+			u.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+		}
+	})
 	return nil
 }
 
@@ -71,67 +286,351 @@ func (self *FSS3) Get(d FileStoreDescriptor) ([]byte, FileStoreLocation, error)
 	if err != nil {
 		return nil, FileStoreLocation{}, err
 	}
+	c, err := self.GetFrom(d, l)
+	return c, l, err
+}
+
+// GetFrom retrieves the file data at a specific location of a descriptor.
+func (self *FSS3) GetFrom(d FileStoreDescriptor, l FileStoreLocation) ([]byte, error) {
+	err := checkLocation(l, self.DriverName())
+	if err != nil {
+		return nil, err
+	}
+	if d.Expired() {
+		return nil, ErrNotFound
+	}
 
 	// Retrieve actual file data from disk
-	c, err := self.bucket.Get(l.Location)
+	o, err := self.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(self.locationBucket(l)),
+		Key:    aws.String(l.Location),
+	})
 	if err != nil {
-		return nil, l, err
+		return nil, s3Error(err)
+	}
+	defer o.Body.Close()
+	c, err := ioutil.ReadAll(o.Body)
+	if err != nil {
+		return nil, err
 	}
 
 	// Send everything back
-	return c, l, nil
+	return c, nil
 }
 
 func (self *FSS3) Put(d FileStoreDescriptor, c []byte) (FileStoreDescriptor, error) {
-	dU := d
+	// A seekable body is uploaded without being copied
+	return self.put(d, "", bytes.NewReader(c))
+}
 
-	// Create new location
-	k := "fs_" + strconv.FormatInt(dU.Id, 16) + "_" + dU.Name
-	l := FileStoreLocation{
-		Id:       "", // dummy driver doesn't have a store name/id
+// PutTo stores file data in the given bucket, bypassing the routes.
+func (self *FSS3) PutTo(d FileStoreDescriptor, bucket string, c []byte) (FileStoreDescriptor, error) {
+	if bucket == "" {
+		bucket = self.BucketName
+	}
+	return self.put(d, bucket, bytes.NewReader(c))
+}
+
+func (self *FSS3) PutReader(d FileStoreDescriptor, r io.Reader) (FileStoreDescriptor, error) {
+	body := &countingReader{Reader: r}
+	dU, err := self.put(d, "", body)
+	if err != nil {
+		return dU, err
+	}
+	dU.Size = body.N
+	return dU, nil
+}
+
+// location creates the location for a new object, in the given bucket or,
+// if that is empty, the one chosen by the routes.
+func (self *FSS3) location(d FileStoreDescriptor, bucket string) (FileStoreLocation, error) {
+	options, err := self.objectOptions(d)
+	if err != nil {
+		return FileStoreLocation{}, err
+	}
+	k := self.Namer.Key(d)
+	if bucket == "" {
+		bucket = self.bucket(d, k)
+	}
+	return FileStoreLocation{
+		Id:       bucket,
 		Driver:   self.DriverName(),
 		Created:  time.Now(),
 		Location: k,
+		Options:  options,
+	}, nil
+}
+
+func (self *FSS3) put(d FileStoreDescriptor, bucket string, body io.Reader) (FileStoreDescriptor, error) {
+	dU := d
+
+	// Create new location
+	l, err := self.location(dU, bucket)
+	if err != nil {
+		return dU, err
 	}
 
 	// Push out to filesystem
-	err := self.bucket.Put(
-		k,
-		c,
-		d.Type,
-		s3.BucketOwnerFull)
+	in := &s3.PutObjectInput{
+		Bucket: aws.String(l.Id),
+		Key:    aws.String(l.Location),
+		Body:   body,
+	}
+	if d.Type != "" {
+		in.ContentType = aws.String(d.Type)
+	}
+	tags := url.Values{}
+	if !dU.Expires.IsZero() {
+		days := (expirySeconds(dU.Expires) + 86399) / 86400
+		in.Expires = aws.Time(dU.Expires)
+		in.Metadata = map[string]string{
+			"fsabstract-expires": dU.Expires.UTC().Format(time.RFC3339),
+		}
+		tags.Set("fsabstract-ttl", strconv.FormatInt(days, 10)+"d")
+	}
+	applyS3Options(in, l.Options, dU.Name, tags)
+	_, err = self.uploader.Upload(context.Background(), in)
 	if err != nil {
 		return dU, err
 	}
 
 	// Append location
-	if dU.Location == nil {
-		dU.Location = make([]FileStoreLocation, 0)
-	}
-	dU.Location = append(dU.Location, l)
+	dU = AddLocation(dU, l)
 
 	// No errors, send back
 	return dU, nil
 }
 
+// Locate returns the location for a new object, for use with a signed PUT
+// URL. No object options are recorded, since a signed PUT can't apply
+// them; use the bucket defaults for encryption and lifecycle instead.
+func (self *FSS3) Locate(d FileStoreDescriptor) (FileStoreLocation, error) {
+	l, err := self.location(d, "")
+	l.Options = nil
+	return l, err
+}
+
+// SignURL presigns a GetObject or PutObject request for a location. A PUT
+// URL only covers the bucket and key, so that any client can use it
+// without sending extra headers.
+func (self *FSS3) SignURL(l FileStoreLocation, method string, ttl time.Duration) (string, error) {
+	p := s3.NewPresignClient(self.client, s3.WithPresignExpires(ttl))
+	bucket := aws.String(self.locationBucket(l))
+	var r *v4.PresignedHTTPRequest
+	var err error
+	switch method {
+	case http.MethodGet:
+		r, err = p.PresignGetObject(context.Background(), &s3.GetObjectInput{Bucket: bucket, Key: aws.String(l.Location)})
+	case http.MethodPut:
+		r, err = p.PresignPutObject(context.Background(), &s3.PutObjectInput{Bucket: bucket, Key: aws.String(l.Location)})
+	default:
+		return "", errors.New("Unable to sign S3 URL for " + method)
+	}
+	if err != nil {
+		return "", err
+	}
+	return r.URL, nil
+}
+
 func (self *FSS3) Delete(d FileStoreDescriptor, l FileStoreLocation) (FileStoreDescriptor, error) {
 	dU := d
 
-	// Find the pertinent FileStoreLocation
-	l, err := LocationForDriver(dU, self.DriverName())
+	// Find the pertinent FileStoreLocation, if we weren't given one
+	l, err := driverLocation(dU, l, self.DriverName())
 	if err != nil {
 		return dU, err
 	}
 
 	// Delete from disk
-	err = self.bucket.Del(l.Location)
+	err = self.del(self.locationBucket(l), l.Location)
 	if err != nil {
 		return dU, err
 	}
 
 	// Remove from mapping
-	RemoveLocation(dU, l)
+	dU = RemoveLocation(dU, l)
 
 	// No errors, send back
 	return dU, nil
 }
+
+func (self *FSS3) Trash(l FileStoreLocation) (FileStoreLocation, error) {
+	lU := l
+	lU.Location = trashPrefix + l.Location
+
+	err := self.move(self.locationBucket(l), l.Location, lU.Location, l.Options)
+	if err != nil {
+		return l, err
+	}
+
+	return lU, nil
+}
+
+func (self *FSS3) Restore(l FileStoreLocation) (FileStoreLocation, error) {
+	lU := l
+	lU.Location = strings.TrimPrefix(l.Location, trashPrefix)
+
+	err := self.move(self.locationBucket(l), l.Location, lU.Location, l.Options)
+	if err != nil {
+		return l, err
+	}
+
+	return lU, nil
+}
+
+func (self *FSS3) Purge(l FileStoreLocation) error {
+	return self.del(self.locationBucket(l), l.Location)
+}
+
+func (self *FSS3) del(bucket, key string) error {
+	_, err := self.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	return s3Error(err)
+}
+
+// move relocates an object from one key to another within a bucket,
+// using a server side copy which keeps its metadata and tags. The storage
+// class, encryption and ACL are not copied, so they are reapplied from the
+// options recorded on the location.
+func (self *FSS3) move(bucket, from, to string, options map[string]string) error {
+	source := &url.URL{Path: bucket + "/" + from}
+	in := &s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(to),
+		CopySource: aws.String(source.EscapedPath()),
+	}
+	if options == nil {
+		// Stored before options were recorded
+		options = map[string]string{"acl": DefaultS3ACL}
+	}
+	if v, exists := options["storageClass"]; exists {
+		in.StorageClass = types.StorageClass(v)
+	}
+	if v, exists := options["sse"]; exists {
+		in.ServerSideEncryption = types.ServerSideEncryption(v)
+	}
+	if v, exists := options["sseKmsKeyId"]; exists {
+		in.SSEKMSKeyId = aws.String(v)
+	}
+	if v, exists := options["acl"]; exists && v != "none" {
+		in.ACL = types.ObjectCannedACL(v)
+	}
+
+	head, err := self.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(from),
+	})
+	if err != nil {
+		return s3Error(err)
+	}
+	if aws.ToInt64(head.ContentLength) > s3MaxCopySize {
+		err = self.copyParts(in, from, head)
+	} else {
+		_, err = self.client.CopyObject(context.Background(), in)
+	}
+	if err != nil {
+		return s3Error(err)
+	}
+	return self.del(bucket, from)
+}
+
+// copyParts performs a copy too large for CopyObject as a multipart upload
+// of ranges of the source. Unlike CopyObject, this doesn't carry over the
+// headers, metadata and tags of the source, so they are set from head and
+// the tags of the source key. The upload is aborted if any part fails.
+func (self *FSS3) copyParts(in *s3.CopyObjectInput, from string, head *s3.HeadObjectOutput) error {
+	ctx := context.Background()
+	tagging, err := self.client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: in.Bucket,
+		Key:    aws.String(from),
+	})
+	if err != nil {
+		return err
+	}
+	tags := url.Values{}
+	for _, t := range tagging.TagSet {
+		tags.Set(aws.ToString(t.Key), aws.ToString(t.Value))
+	}
+
+	create := &s3.CreateMultipartUploadInput{
+		Bucket:               in.Bucket,
+		Key:                  in.Key,
+		StorageClass:         in.StorageClass,
+		ServerSideEncryption: in.ServerSideEncryption,
+		SSEKMSKeyId:          in.SSEKMSKeyId,
+		ACL:                  in.ACL,
+		CacheControl:         head.CacheControl,
+		ContentDisposition:   head.ContentDisposition,
+		ContentEncoding:      head.ContentEncoding,
+		ContentLanguage:      head.ContentLanguage,
+		ContentType:          head.ContentType,
+		Expires:              head.Expires,
+		Metadata:             head.Metadata,
+	}
+	if len(tags) > 0 {
+		create.Tagging = aws.String(tags.Encode())
+	}
+	upload, err := self.client.CreateMultipartUpload(ctx, create)
+	if err != nil {
+		return err
+	}
+
+	size := aws.ToInt64(head.ContentLength)
+	partSize := self.PartSize
+	if least := (size + s3MaxParts - 1) / s3MaxParts; partSize < least {
+		partSize = least
+	}
+	if partSize > s3MaxCopySize {
+		partSize = s3MaxCopySize
+	}
+	parts := make([]types.CompletedPart, 0, (size+partSize-1)/partSize)
+	for start := int64(0); start < size && err == nil; start += partSize {
+		end := start + partSize
+		if end > size {
+			end = size
+		}
+		n := aws.Int32(int32(len(parts) + 1))
+		var out *s3.UploadPartCopyOutput
+		out, err = self.client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          in.Bucket,
+			Key:             in.Key,
+			CopySource:      in.CopySource,
+			CopySourceRange: aws.String("bytes=" + strconv.FormatInt(start, 10) + "-" + strconv.FormatInt(end-1, 10)),
+			PartNumber:      n,
+			UploadId:        upload.UploadId,
+		})
+		if err == nil {
+			parts = append(parts, types.CompletedPart{ETag: out.CopyPartResult.ETag, PartNumber: n})
+		}
+	}
+	if err == nil {
+		_, err = self.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          in.Bucket,
+			Key:             in.Key,
+			UploadId:        upload.UploadId,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		})
+	}
+	if err != nil {
+		self.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   in.Bucket,
+			Key:      in.Key,
+			UploadId: upload.UploadId,
+		})
+	}
+	return err
+}
+
+// s3Error maps S3 errors onto the errors returned by drivers.
+func s3Error(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return ErrNotFound
+		}
+	}
+	return err
+}
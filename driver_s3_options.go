@@ -0,0 +1,150 @@
+package fsabstract
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"mime"
+	"net/url"
+	"strings"
+)
+
+const (
+	// DefaultS3ACL is the canned ACL applied to new objects unless another
+	// is configured. The ACL "none" sends no ACL at all, for services
+	// which don't support them.
+	DefaultS3ACL = "bucket-owner-full-control"
+)
+
+var (
+	// s3OptionKeys lists the object options. Each is configured with the
+	// fs.s3.<option> key, and can be overridden for a single file by a
+	// FileStoreDescriptor Metadata entry with the same key.
+	s3OptionKeys = []string{
+		"storageClass",
+		"sse",
+		"sseKmsKeyId",
+		"acl",
+		"cacheControl",
+		"contentDisposition",
+		"tags",
+	}
+)
+
+// options returns the configured object options, before overrides.
+func (self *FSS3) options() map[string]string {
+	o := map[string]string{
+		"storageClass":       self.StorageClass,
+		"sse":                self.SSE,
+		"sseKmsKeyId":        self.SSEKMSKeyId,
+		"acl":                self.ACL,
+		"cacheControl":       self.CacheControl,
+		"contentDisposition": self.ContentDisposition,
+		"tags":               self.Tags,
+	}
+	if o["acl"] == "" {
+		o["acl"] = DefaultS3ACL
+	}
+	for k, v := range o {
+		if v == "" {
+			delete(o, k)
+		}
+	}
+	return o
+}
+
+// objectOptions resolves the object options for a file, applying any
+// overrides from its metadata.
+func (self *FSS3) objectOptions(d FileStoreDescriptor) (map[string]string, error) {
+	o := self.options()
+	for _, k := range s3OptionKeys {
+		if v, exists := d.Metadata["fs.s3."+k]; exists {
+			if v == "" {
+				delete(o, k)
+			} else {
+				o[k] = v
+			}
+		}
+	}
+	return o, validateS3Options(o)
+}
+
+func validateS3Options(o map[string]string) error {
+	if v, exists := o["storageClass"]; exists && !s3Valid(v, types.StorageClass("").Values()) {
+		return errors.New("Unknown S3 storage class " + v)
+	}
+	if v, exists := o["sse"]; exists && !s3Valid(v, types.ServerSideEncryption("").Values()) {
+		return errors.New("Unknown S3 server side encryption " + v)
+	}
+	if _, exists := o["sseKmsKeyId"]; exists && !strings.HasPrefix(o["sse"], "aws:kms") {
+		return errors.New("S3 KMS key set without KMS server side encryption")
+	}
+	if v, exists := o["acl"]; exists && v != "none" && !s3Valid(v, types.ObjectCannedACL("").Values()) {
+		return errors.New("Unknown S3 canned ACL " + v)
+	}
+	if v, exists := o["contentDisposition"]; exists && v != "inline" && v != "attachment" {
+		return errors.New("Unknown S3 content disposition " + v)
+	}
+	if v, exists := o["tags"]; exists {
+		_, err := parseS3Tags(v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyS3Options sets the object options on an upload. Tags are added to
+// any already present in tags.
+func applyS3Options(in *s3.PutObjectInput, o map[string]string, name string, tags url.Values) {
+	if v, exists := o["storageClass"]; exists {
+		in.StorageClass = types.StorageClass(v)
+	}
+	if v, exists := o["sse"]; exists {
+		in.ServerSideEncryption = types.ServerSideEncryption(v)
+	}
+	if v, exists := o["sseKmsKeyId"]; exists {
+		in.SSEKMSKeyId = aws.String(v)
+	}
+	if v, exists := o["acl"]; exists && v != "none" {
+		in.ACL = types.ObjectCannedACL(v)
+	}
+	if v, exists := o["cacheControl"]; exists {
+		in.CacheControl = aws.String(v)
+	}
+	if v, exists := o["contentDisposition"]; exists {
+		in.ContentDisposition = aws.String(mime.FormatMediaType(v, map[string]string{"filename": name}))
+	}
+	if v, exists := o["tags"]; exists {
+		t, _ := parseS3Tags(v)
+		for k := range t {
+			tags.Set(k, t.Get(k))
+		}
+	}
+	if len(tags) > 0 {
+		in.Tagging = aws.String(tags.Encode())
+	}
+}
+
+// parseS3Tags parses object tags given as "key=value,key=value".
+func parseS3Tags(v string) (url.Values, error) {
+	tags := url.Values{}
+	for _, t := range splitList(v) {
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.New("Unable to parse S3 tag " + t)
+		}
+		tags.Set(kv[0], kv[1])
+	}
+	return tags, nil
+}
+
+func s3Valid[T ~string](v string, values []T) bool {
+	for _, a := range values {
+		if string(a) == v {
+			return true
+		}
+	}
+	return false
+}
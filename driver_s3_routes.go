@@ -0,0 +1,120 @@
+package fsabstract
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"path"
+	"strings"
+)
+
+// s3Route sends new objects matching a rule to a bucket other than the
+// default one.
+type s3Route struct {
+	kind    string // type, meta or hash
+	key     string // metadata key, for meta rules
+	pattern string // type or metadata value pattern, or low hash prefix
+	high    string // high hash prefix, for hash rules
+	bucket  string
+}
+
+// parseS3Routes parses bucket routing rules, given as a list of
+// "<rule>=<bucket>", where each rule is one of:
+//
+//	type:<pattern>        the descriptor Type matches pattern, ie: image/*
+//	meta:<key>:<pattern>  the Metadata entry key exists and matches pattern
+//	hash:<low>[-<high>]   the hex SHA-256 of the object key starts with a
+//	                      prefix between low and high, ie: hash:0-7
+//
+// Patterns use path.Match syntax.
+func parseS3Routes(v string) ([]s3Route, error) {
+	routes := make([]s3Route, 0)
+	for _, rule := range splitList(v) {
+		i := strings.LastIndex(rule, "=")
+		if i < 0 || i == len(rule)-1 {
+			return nil, errors.New("No bucket for S3 route " + rule)
+		}
+		r := s3Route{bucket: rule[i+1:]}
+		kind, match, _ := strings.Cut(rule[:i], ":")
+		r.kind = kind
+		switch kind {
+		case "type":
+			r.pattern = match
+		case "meta":
+			r.key, r.pattern, _ = strings.Cut(match, ":")
+			if r.key == "" {
+				return nil, errors.New("No metadata key for S3 route " + rule)
+			}
+			if r.pattern == "" {
+				r.pattern = "*"
+			}
+		case "hash":
+			low, high, ranged := strings.Cut(strings.ToLower(match), "-")
+			if !ranged {
+				high = low
+			}
+			if !s3HashPrefix(low) || len(high) != len(low) || !s3HashPrefix(high) || high < low {
+				return nil, errors.New("Unable to parse hash range of S3 route " + rule)
+			}
+			r.pattern, r.high = low, high
+		default:
+			return nil, errors.New("Unknown S3 route " + rule)
+		}
+		if kind != "hash" {
+			if _, err := path.Match(r.pattern, ""); err != nil {
+				return nil, errors.New("Unable to parse pattern of S3 route " + rule)
+			}
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// matches determines whether a new object falls under the rule.
+func (self s3Route) matches(d FileStoreDescriptor, key string) bool {
+	switch self.kind {
+	case "type":
+		ok, _ := path.Match(self.pattern, d.Type)
+		return ok
+	case "meta":
+		v, exists := d.Metadata[self.key]
+		if !exists {
+			return false
+		}
+		ok, _ := path.Match(self.pattern, v)
+		return ok
+	case "hash":
+		sum := sha256.Sum256([]byte(key))
+		p := hex.EncodeToString(sum[:])[:len(self.pattern)]
+		return p >= self.pattern && p <= self.high
+	}
+	return false
+}
+
+// bucket picks the bucket for a new object: the first matching route, or
+// BucketName if none match.
+func (self *FSS3) bucket(d FileStoreDescriptor, key string) string {
+	for _, r := range self.routes {
+		if r.matches(d, key) {
+			return r.bucket
+		}
+	}
+	return self.BucketName
+}
+
+// locationBucket returns the bucket holding a location. Locations stored
+// before the bucket was recorded are in BucketName.
+func (self *FSS3) locationBucket(l FileStoreLocation) string {
+	if l.Id == "" {
+		return self.BucketName
+	}
+	return l.Id
+}
+
+func s3HashPrefix(v string) bool {
+	if v == "" || len(v) > sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(v + strings.Repeat("0", len(v)%2))
+	return err == nil
+}
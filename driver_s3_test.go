@@ -0,0 +1,537 @@
+package fsabstract
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-process S3-compatible server, supporting just enough of
+// the API for the driver tests. Objects are addressed path-style.
+type fakeS3 struct {
+	lock    sync.Mutex
+	objects map[string]fakeS3Object
+	uploads map[string]map[int][]byte
+	headers map[string]http.Header // of each upload, when created
+	nextId  int
+	aborted int
+	// copiedParts counts the parts copied from other objects
+	copiedParts int
+	// failParts counts the remaining failures for each part number
+	failParts map[int]int
+}
+
+type fakeS3Object struct {
+	data   []byte
+	header http.Header
+}
+
+func newFakeS3(t *testing.T, extra map[string]string) (*fakeS3, *FSS3) {
+	f := &fakeS3{
+		objects:   map[string]fakeS3Object{},
+		uploads:   map[string]map[int][]byte{},
+		headers:   map[string]http.Header{},
+		failParts: map[int]int{},
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	c := map[string]string{
+		"fs.s3.bucket":    "test",
+		"fs.s3.accesskey": "access",
+		"fs.s3.secretkey": "secret",
+		"fs.s3.endpoint":  srv.URL,
+		"fs.s3.pathStyle": "true",
+	}
+	for k, v := range extra {
+		c[k] = v
+	}
+	d := new(FSS3)
+	d.Configure(c)
+	err := d.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, d
+}
+
+func (self *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	presigned := r.URL.Query().Get("X-Amz-Algorithm") == "AWS4-HMAC-SHA256"
+	if !presigned && !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	q := r.URL.Query()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if _, exists := q["uploads"]; exists && r.Method == "POST" {
+		self.nextId++
+		id := strconv.Itoa(self.nextId)
+		self.uploads[id] = map[int][]byte{}
+		self.headers[id] = r.Header.Clone()
+		w.Write([]byte("<InitiateMultipartUploadResult><Key>" + key + "</Key><UploadId>" + id + "</UploadId></InitiateMultipartUploadResult>"))
+		return
+	}
+	if id := q.Get("uploadId"); id != "" {
+		self.multipart(w, r, key, id)
+		return
+	}
+
+	if _, exists := q["tagging"]; exists && r.Method == "GET" {
+		o, exists := self.objects[key]
+		if !exists {
+			self.notFound(w)
+			return
+		}
+		tags, _ := url.ParseQuery(o.header.Get("X-Amz-Tagging"))
+		w.Write([]byte("<Tagging><TagSet>"))
+		for k := range tags {
+			w.Write([]byte("<Tag><Key>" + k + "</Key><Value>" + tags.Get(k) + "</Value></Tag>"))
+		}
+		w.Write([]byte("</TagSet></Tagging>"))
+		return
+	}
+
+	switch r.Method {
+	case "HEAD":
+		o, exists := self.objects[key]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for k, v := range o.header {
+			if strings.HasPrefix(k, "X-Amz-Meta-") || k == "Content-Type" || k == "Content-Disposition" {
+				w.Header()[k] = v
+			}
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+	case "PUT":
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			src, _ = url.PathUnescape(strings.TrimPrefix(src, "/"))
+			o, exists := self.objects[src]
+			if !exists {
+				self.notFound(w)
+				return
+			}
+			self.objects[key] = o
+			w.Write([]byte("<CopyObjectResult><ETag>\"x\"</ETag></CopyObjectResult>"))
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		self.objects[key] = fakeS3Object{data: data, header: r.Header.Clone()}
+	case "GET":
+		o, exists := self.objects[key]
+		if !exists {
+			self.notFound(w)
+			return
+		}
+		w.Write(o.data)
+	case "DELETE":
+		delete(self.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (self *fakeS3) multipart(w http.ResponseWriter, r *http.Request, key, id string) {
+	parts, exists := self.uploads[id]
+	if !exists {
+		http.Error(w, "<Error><Code>NoSuchUpload</Code></Error>", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		n, _ := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		data, _ := ioutil.ReadAll(r.Body)
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			src, _ = url.PathUnescape(strings.TrimPrefix(src, "/"))
+			var start, end int
+			fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end)
+			data = self.objects[src].data[start : end+1]
+			self.copiedParts++
+			w.Write([]byte("<CopyPartResult><ETag>\"part" + strconv.Itoa(n) + "\"</ETag></CopyPartResult>"))
+		}
+		if self.failParts[n] > 0 {
+			self.failParts[n]--
+			http.Error(w, "<Error><Code>InternalError</Code></Error>", http.StatusInternalServerError)
+			return
+		}
+		parts[n] = data
+		w.Header().Set("ETag", "\"part"+strconv.Itoa(n)+"\"")
+	case "POST":
+		data := make([]byte, 0)
+		for n := 1; n <= len(parts); n++ {
+			data = append(data, parts[n]...)
+		}
+		self.objects[key] = fakeS3Object{data: data, header: self.headers[id]}
+		delete(self.uploads, id)
+		w.Write([]byte("<CompleteMultipartUploadResult><Key>" + key + "</Key><ETag>\"x\"</ETag></CompleteMultipartUploadResult>"))
+	case "DELETE":
+		delete(self.uploads, id)
+		self.aborted++
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (self *fakeS3) notFound(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte("<Error><Code>NoSuchKey</Code><Message>Not found</Message></Error>"))
+}
+
+func TestS3Driver(t *testing.T) {
+	f, d := newFakeS3(t, nil)
+
+	fd, err := d.Put(FileStoreDescriptor{
+		Id:      1,
+		Name:    "a file.txt",
+		Type:    "text/plain",
+		Expires: time.Now().Add(36 * time.Hour),
+	}, []byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, exists := f.objects["test/fs_1_a%20file.txt"]
+	if !exists {
+		t.Fatalf("Object not stored at %s", fd.Location[0].Location)
+	}
+	if o.header.Get("Content-Type") != "text/plain" || o.header.Get("X-Amz-Tagging") != "fsabstract-ttl=2d" {
+		t.Errorf("Stored with headers %v", o.header)
+	}
+
+	c, _, err := d.Get(fd)
+	if err != nil || string(c) != "content" {
+		t.Fatalf("Get returned %q, %v", c, err)
+	}
+
+	l, err := d.Trash(fd.Location[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = d.Get(fd); err != ErrNotFound {
+		t.Errorf("Get of trashed object returned %v", err)
+	}
+	if _, err = d.Restore(l); err != nil {
+		t.Fatal(err)
+	}
+
+	if fd, err = d.Delete(fd, fd.Location[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.objects) != 0 || len(fd.Location) != 0 {
+		t.Errorf("Objects remain after delete: %v", f.objects)
+	}
+
+	testDriverLocations(t, d)
+}
+
+func TestS3Multipart(t *testing.T) {
+	f, d := newFakeS3(t, map[string]string{
+		"fs.s3.partSize":    "5242880",
+		"fs.s3.concurrency": "2",
+		"fs.s3.retries":     "2",
+	})
+	data := bytes.Repeat([]byte("0123456789abcdef"), 11*1024*1024/16)
+
+	// A part which fails once is retried
+	f.failParts[2] = 1
+	fd, err := d.PutReader(FileStoreDescriptor{Id: 1, Name: "large"}, io.MultiReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fd.Size != int64(len(data)) || !bytes.Equal(f.objects["test/fs_1_large"].data, data) {
+		t.Errorf("Stored %d bytes, expected %d", len(f.objects["test/fs_1_large"].data), len(data))
+	}
+
+	// A part which keeps failing aborts the upload
+	f.failParts[2] = 2
+	_, err = d.PutReader(FileStoreDescriptor{Id: 2, Name: "large"}, io.MultiReader(bytes.NewReader(data)))
+	if err == nil {
+		t.Fatal("Expected upload to fail")
+	}
+	if _, exists := f.objects["test/fs_2_large"]; exists || f.aborted != 1 || len(f.uploads) != 0 {
+		t.Errorf("Failed upload was not aborted")
+	}
+}
+
+func TestS3MultipartCopy(t *testing.T) {
+	f, d := newFakeS3(t, nil)
+	defer func(n int64) { s3MaxCopySize = n }(s3MaxCopySize)
+	s3MaxCopySize = 4
+
+	fd, err := d.Put(FileStoreDescriptor{Id: 1, Name: "a", Type: "text/plain", Expires: time.Now().Add(time.Hour)}, []byte("0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl, err := d.Trash(fd.Location[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, exists := f.objects["test/"+tl.Location]
+	if !exists || string(o.data) != "0123456789" || f.copiedParts != 3 {
+		t.Fatalf("Trash copied %q in %d parts", o.data, f.copiedParts)
+	}
+	for _, k := range []string{"Content-Type", "X-Amz-Meta-Fsabstract-Expires", "X-Amz-Tagging", "X-Amz-Acl"} {
+		if o.header.Get(k) == "" {
+			t.Errorf("%s not kept by a copy in parts", k)
+		}
+	}
+	if _, exists := f.objects["test/fs_1_a"]; exists || len(f.uploads) != 0 {
+		t.Error("Copy in parts left the source or the upload")
+	}
+
+	rl, err := d.Restore(tl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := GetFrom(d, fd, rl); err != nil || string(c) != "0123456789" {
+		t.Errorf("Get after restore returned %q, %v", c, err)
+	}
+}
+
+func TestS3ObjectOptions(t *testing.T) {
+	f, d := newFakeS3(t, map[string]string{
+		"fs.s3.storageClass":       "STANDARD_IA",
+		"fs.s3.sse":                "aws:kms",
+		"fs.s3.sseKmsKeyId":        "key-1",
+		"fs.s3.contentDisposition": "attachment",
+		"fs.s3.tags":               "team=files",
+	})
+
+	fd, err := d.Put(FileStoreDescriptor{
+		Id:       1,
+		Name:     "report.pdf",
+		Metadata: map[string]string{"fs.s3.storageClass": "GLACIER_IR", "fs.s3.tags": "team=reports,kind=pdf"},
+	}, []byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := f.objects["test/fs_1_report.pdf"].header
+	for k, v := range map[string]string{
+		"X-Amz-Storage-Class":                         "GLACIER_IR",
+		"X-Amz-Server-Side-Encryption":                "aws:kms",
+		"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "key-1",
+		"X-Amz-Acl":           DefaultS3ACL,
+		"Content-Disposition": "attachment; filename=report.pdf",
+		"X-Amz-Tagging":       "kind=pdf&team=reports",
+	} {
+		if h.Get(k) != v {
+			t.Errorf("%s was %q, expected %q", k, h.Get(k), v)
+		}
+	}
+	if o := fd.Location[0].Options; o["storageClass"] != "GLACIER_IR" || o["sseKmsKeyId"] != "key-1" {
+		t.Errorf("Recorded options %v", o)
+	}
+
+	_, err = d.Put(FileStoreDescriptor{Id: 2, Name: "x", Metadata: map[string]string{"fs.s3.acl": "everyone"}}, []byte("x"))
+	if err == nil {
+		t.Error("Expected unknown ACL to be rejected")
+	}
+}
+
+func TestS3Routes(t *testing.T) {
+	f, d := newFakeS3(t, map[string]string{
+		"fs.s3.routes": "type:image/*=images,meta:tenant:acme=acme",
+	})
+
+	for _, c := range []struct {
+		d      FileStoreDescriptor
+		bucket string
+	}{
+		{FileStoreDescriptor{Id: 1, Name: "a.png", Type: "image/png"}, "images"},
+		{FileStoreDescriptor{Id: 2, Name: "b.txt", Metadata: map[string]string{"tenant": "acme"}}, "acme"},
+		{FileStoreDescriptor{Id: 3, Name: "c.txt", Type: "text/plain"}, "test"},
+	} {
+		fd, err := d.Put(c.d, []byte(c.d.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := fd.Location[0]
+		if l.Id != c.bucket {
+			t.Errorf("%s stored in bucket %q, expected %q", c.d.Name, l.Id, c.bucket)
+		}
+		if _, exists := f.objects[c.bucket+"/"+l.Location]; !exists {
+			t.Errorf("%s not found in bucket %s", c.d.Name, c.bucket)
+		}
+
+		// The location is read from its own bucket, whatever the default
+		l, err = d.Trash(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, exists := f.objects[c.bucket+"/"+l.Location]; !exists {
+			t.Errorf("%s not trashed in bucket %s", c.d.Name, c.bucket)
+		}
+		l, err = d.Restore(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other := *d
+		other.BucketName = "other"
+		b, _, err := other.Get(fd)
+		if err != nil || string(b) != c.d.Name {
+			t.Errorf("Get of %s returned %q, %v", c.d.Name, b, err)
+		}
+	}
+
+	// Locations without a bucket are in the default bucket
+	f.objects["test/legacy"] = fakeS3Object{data: []byte("legacy")}
+	b, _, err := d.Get(FileStoreDescriptor{Location: []FileStoreLocation{{Driver: "s3", Location: "legacy"}}})
+	if err != nil || string(b) != "legacy" {
+		t.Errorf("Get of legacy location returned %q, %v", b, err)
+	}
+
+	// Hash ranges split keys between buckets
+	routes, err := parseS3Routes("hash:0-7=low,hash:8-f=high")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.routes = routes
+	seen := map[string]bool{}
+	for i := 0; i < 16; i++ {
+		seen[d.bucket(FileStoreDescriptor{}, "key"+strconv.Itoa(i))] = true
+	}
+	if !seen["low"] || !seen["high"] || seen["test"] {
+		t.Errorf("Hash routes used buckets %v", seen)
+	}
+
+	for _, v := range []string{"type:image/*", "color:red=b", "hash:g=b", "hash:8-1=b", "hash:0-ff=b", "meta:=b"} {
+		if _, err := parseS3Routes(v); err == nil {
+			t.Errorf("Expected route %q to be rejected", v)
+		}
+	}
+}
+
+func TestS3SignURL(t *testing.T) {
+	f, d := newFakeS3(t, map[string]string{"fs.s3.routes": "type:image/*=images"})
+
+	l, err := d.Locate(FileStoreDescriptor{Id: 1, Name: "a.png", Type: "image/png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Id != "images" || l.Options != nil {
+		t.Errorf("Located at %s", l.ToString())
+	}
+	u, err := d.SignURL(l, http.MethodPut, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPut, u, strings.NewReader("image"))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if _, exists := f.objects["images/"+l.Location]; !exists || res.StatusCode != http.StatusOK {
+		t.Fatalf("Signed PUT returned %s", res.Status)
+	}
+
+	u, err = d.SignURL(l, http.MethodGet, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(u, "X-Amz-Expires=60") {
+		t.Errorf("Signed URL %s", u)
+	}
+	res, err = http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(b) != "image" {
+		t.Errorf("Signed GET returned %q", b)
+	}
+
+	if _, err = d.SignURL(l, http.MethodDelete, time.Minute); err == nil {
+		t.Error("Expected DELETE URL to be refused")
+	}
+}
+
+func TestS3Copies(t *testing.T) {
+	f, d := newFakeS3(t, nil)
+
+	fd, err := d.Put(FileStoreDescriptor{Id: 1, Name: "a"}, []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err = d.PutTo(fd, "second", []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copies := LocationsForDriver(fd, "s3")
+	if len(copies) != 2 || len(LocationsForStore(fd, "s3", "second")) != 1 {
+		t.Fatalf("Stored copies %v", fd.Location)
+	}
+
+	for i, want := range []string{"first", "second"} {
+		c, err := GetFrom(d, fd, copies[i])
+		if err != nil || string(c) != want {
+			t.Errorf("GetFrom %s returned %q, %v", copies[i].Id, c, err)
+		}
+	}
+
+	// Only the given copy is deleted
+	fd, err = d.Delete(fd, copies[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := f.objects["second/fs_1_a"]; exists || len(fd.Location) != 1 || fd.Location[0].Id != "test" {
+		t.Errorf("Delete left locations %v", fd.Location)
+	}
+	if _, exists := f.objects["test/fs_1_a"]; !exists {
+		t.Error("Delete removed the wrong copy")
+	}
+
+	if _, err = d.Delete(fd, FileStoreLocation{Driver: "dummy", Location: "file_1"}); err == nil {
+		t.Error("Expected location of another driver to be refused")
+	}
+
+	// Migrating a copy onto itself would delete it
+	if _, err = Migrate(d, d, fd, fd.Location[0], FileStoreLocation{Driver: "s3", Id: "test"}); err != ErrSameLocation {
+		t.Errorf("Migrate to the same bucket returned %v", err)
+	}
+
+	// Between buckets
+	fd, err = Migrate(d, d, fd, fd.Location[0], FileStoreLocation{Driver: "s3", Id: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o, exists := f.objects["other/fs_1_a"]; !exists || string(o.data) != "first" {
+		t.Errorf("Migrate stored %q", o.data)
+	}
+	if _, exists := f.objects["test/fs_1_a"]; exists || len(fd.Location) != 1 || fd.Location[0].Id != "other" {
+		t.Errorf("Migrate left locations %v", fd.Location)
+	}
+
+	// Between drivers
+	l, cleanup := testLocalDriver(t, nil)
+	defer cleanup()
+	if _, err = Migrate(l, d, fd, fd.Location[0], FileStoreLocation{Driver: "local"}); err == nil {
+		t.Error("Expected a driver not matching the location to be refused")
+	}
+	fd, err = Migrate(d, l, fd, fd.Location[0], FileStoreLocation{Driver: "local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _, err := l.Get(fd); err != nil || string(c) != "first" || len(fd.Location) != 1 {
+		t.Errorf("Migrate to local gave %q at %v, %v", c, fd.Location, err)
+	}
+	if _, exists := f.objects["other/fs_1_a"]; exists {
+		t.Error("Migrate to local left the source object")
+	}
+}
@@ -0,0 +1,51 @@
+package fsabstract
+
+import (
+	"errors"
+	"strconv"
+)
+
+var (
+	// ErrNotFound is returned by drivers when the requested file data does
+	// not exist, or has expired.
+	ErrNotFound = errors.New("File not found")
+	// ErrConflict is returned by drivers when file data was modified by
+	// another writer during an update, and the update was abandoned.
+	ErrConflict = errors.New("File modified concurrently")
+	// ErrInvalidLocation is returned by drivers when a location refers to
+	// data outside of the store, and so can't have been created by it.
+	ErrInvalidLocation = errors.New("Location outside of store")
+	// ErrNoSpace is matched, with errors.Is, by the SpaceError returned by
+	// drivers when file data would not fit.
+	ErrNoSpace = errors.New("Insufficient space")
+	// ErrSameLocation is returned by Migrate when the destination is the
+	// location being migrated from.
+	ErrSameLocation = errors.New("Source and destination locations are the same")
+)
+
+// SpaceError is returned by local drivers when storing file data would
+// exceed the quota of a store, or leave less than its reserved space free
+// on disk.
+type SpaceError struct {
+	Path      string // base path of the store
+	Size      int64  // bytes needed, or -1 if not known in advance
+	Available int64  // bytes which could still be stored
+	Quota     bool   // whether the quota, rather than the disk, is the limit
+}
+
+func (self *SpaceError) Error() string {
+	limit := "free space"
+	if self.Quota {
+		limit = "quota"
+	}
+	needed := "more than " + strconv.FormatInt(self.Available, 10)
+	if self.Size >= 0 {
+		needed = strconv.FormatInt(self.Size, 10)
+	}
+	return "Insufficient space in " + self.Path + " : " + needed + " bytes needed, " +
+		strconv.FormatInt(self.Available, 10) + " bytes of " + limit + " available"
+}
+
+func (self *SpaceError) Unwrap() error {
+	return ErrNoSpace
+}
@@ -1,109 +1,360 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"flag"
 	martini "github.com/go-martini/martini"
 	fsabstract "github.com/jbuchbinder/fsabstract"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 )
 
 var (
-	DRIVER        = flag.String("driver", "dummy", "Driver")
-	Driver        fsabstract.FileStoreDriver
-	GlobalCounter int64
+	DRIVER      = flag.String("driver", "dummy", "Driver")
+	TRASH       = flag.Duration("trash", fsabstract.DefaultTrashRetention, "Trash retention period")
+	CATALOG     = flag.String("catalog", "bolt", "Descriptor store")
+	IDGEN       = flag.String("idgen", "catalog", "Id generator (catalog, snowflake, redis)")
+	NODE        = flag.String("node", "0", "Node id, for the snowflake id generator")
+	REDIS       = flag.String("redis", "redis://127.0.0.1:6379/0", "Redis server, for the redis id generator")
+	REDIRECT    = flag.Duration("redirect", 0, "Redirect clients to signed URLs valid for this long, instead of proxying file data")
+	URLBASE     = flag.String("urlbase", "http://127.0.0.1:3000", "Address of this service, for signed dummy driver URLs")
+	URLKEY      = flag.String("urlkey", "", "Key for signed dummy driver URLs")
+	SHARDS      = flag.Int("shards", 0, "Directory levels to shard dummy driver files across (see fsreshard)")
+	Driver      *fsabstract.FSSoftDelete
+	Catalog     fsabstract.DescriptorStore
+	IdGenerator fsabstract.IdGenerator
 )
 
 func main() {
 	flag.Parse()
 
-	GlobalCounter = 0
-
 	// HACK! FIXME! TODO!
 	c := make(map[string]string)
 	c["fs.dummy.basepath"] = "." + string(os.PathSeparator) + "store"
+	c["fs.dummy.sweepInterval"] = "1m"
+	c["fs.local.sweepInterval"] = "1m"
+	c["fs.dummy.shardDepth"] = strconv.Itoa(*SHARDS)
+	c["fs.dummy.legacyLocations"] = "true"
+	c["fs.catalog.bolt.path"] = "." + string(os.PathSeparator) + "catalog.db"
+	c["fs.idgen.snowflake.node"] = *NODE
+	c["fs.idgen.redis.server"] = *REDIS
+	c["fs.dummy.urlBase"] = *URLBASE
+	c["fs.dummy.urlKey"] = *URLKEY
 
 	log.Print("Attempting to load driver " + *DRIVER)
-	Driver = fsabstract.GetDriver(*DRIVER)
-	if Driver == nil {
+	d := fsabstract.GetDriver(*DRIVER)
+	if d == nil {
 		panic("Invalid driver")
 	}
+	// Deletes are soft, so that they can be undone
+	Driver = fsabstract.NewSoftDelete(d)
+	Driver.Retention = *TRASH
 	Driver.Configure(c)
 	err := Driver.Initialize()
 	if err != nil {
 		panic(err)
 	}
 
+	log.Print("Attempting to load descriptor store " + *CATALOG)
+	Catalog = fsabstract.GetDescriptorStore(*CATALOG)
+	if Catalog == nil {
+		panic("Invalid descriptor store")
+	}
+	Catalog.Configure(c)
+	err = Catalog.Initialize()
+	if err != nil {
+		panic(err)
+	}
+	defer Catalog.Close()
+
+	log.Print("Attempting to load id generator " + *IDGEN)
+	if *IDGEN == "catalog" {
+		IdGenerator = fsabstract.NewCatalogIdGenerator(Catalog)
+	} else {
+		IdGenerator = fsabstract.GetIdGenerator(*IDGEN)
+	}
+	if IdGenerator == nil {
+		panic("Invalid id generator")
+	}
+	IdGenerator.Configure(c)
+	err = IdGenerator.Initialize()
+	if err != nil {
+		panic(err)
+	}
+
+	// Purge soft deleted files once they have been in the trash for long
+	// enough
+	Driver.StartPurge(time.Hour, func() []fsabstract.FileStoreDescriptor {
+		all, err := Catalog.Query(fsabstract.DescriptorQuery{})
+		if err != nil {
+			log.Print(err)
+		}
+		return all
+	}, func(fsd fsabstract.FileStoreDescriptor) {
+		err := fsabstract.SaveDescriptor(Catalog, fsd)
+		if err != nil {
+			log.Print(err)
+		}
+	})
+
 	m := martini.Classic()
 	m.Get("/", func() string {
 		return "Hello world!"
 	})
 	// Route storage requests properly
 	m.Group("/resource", func(r martini.Router) {
-		r.Get("/**", GetResource)
+		r.Get("/:id", GetResource)
 		//r.Post("/new", NewResource)
-		r.Put("/new/:name", func(res http.ResponseWriter, req *http.Request) {
+		r.Put("/new/:name", func(res http.ResponseWriter, req *http.Request, params martini.Params) {
 			log.Print("Got PUT request")
-			// Sluck in
-			name := "test"
-			data, err := ioutil.ReadAll(req.Body)
-			if err != nil {
-				res.Write([]byte("ERROR"))
-				res.WriteHeader(500) // HTTP 500
+			name := params["name"]
+			// Optional time to live, ie: ?ttl=24h
+			var expires time.Time
+			if v := req.URL.Query().Get("ttl"); v != "" {
+				ttl, err := time.ParseDuration(v)
+				if err != nil {
+					res.WriteHeader(400) // HTTP 400
+					res.Write([]byte("ERROR"))
+					return
+				}
+				expires = time.Now().Add(ttl)
+			}
+			if *REDIRECT > 0 {
+				// Send the client to a signed URL to upload the data to
+				RedirectResource(res, req, name, expires)
 				return
 			}
-			res.Write([]byte(CreateResource(name, data)))
+			// Stream the body through to the driver, so that large uploads
+			// aren't held in memory
+			res.Write([]byte(CreateResource(name, req.Body, expires)))
 			res.WriteHeader(200) // HTTP 200
 		})
 		r.Delete("/:id", DeleteResource)
+		r.Post("/:id/undelete", UndeleteResource)
 	})
+	// Signed URLs handed out for the dummy driver
+	m.Get("/signed", SignedResource)
+	m.Put("/signed", SignedResource)
 	//http.Handle("/", m)
 	m.Run()
 }
 
-func GetResource(params martini.Params) string {
+func GetResource(res http.ResponseWriter, req *http.Request, params martini.Params) {
 	log.Print("Got GET request")
-	f := params["_1"]
-	var fsd fsabstract.FileStoreDescriptor
-	err := json.Unmarshal([]byte(f), &fsd)
+	fsd, err := LoadResource(params["id"])
+	if err == nil && fsd.Expired() {
+		err = fsabstract.ErrNotFound
+	}
 	if err != nil {
-		log.Print(err)
-		return ""
+		ResourceError(res, req, err)
+		return
+	}
+	if s, ok := Driver.Driver.(fsabstract.URLSigner); ok && *REDIRECT > 0 {
+		fsl, err := fsabstract.LocationForDriver(fsd, Driver.DriverName())
+		if err != nil {
+			log.Print(err)
+			http.NotFound(res, req)
+			return
+		}
+		u, err := s.SignURL(fsl, "GET", *REDIRECT)
+		if err != nil {
+			log.Print(err)
+			http.Error(res, "ERROR", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(res, req, u, http.StatusFound)
+		return
 	}
 	data, fsl, err := Driver.Get(fsd)
+	if err != nil {
+		ResourceError(res, req, err)
+		return
+	}
 	log.Print("FSL : " + fsl.ToString())
-	return string(data)
+	res.Write(data)
+}
+
+// ResourceError logs an error and reports it to the client, as not found
+// for missing or expired files and as an internal error otherwise.
+func ResourceError(res http.ResponseWriter, req *http.Request, err error) {
+	log.Print(err)
+	if errors.Is(err, fsabstract.ErrNotFound) {
+		http.NotFound(res, req)
+		return
+	}
+	http.Error(res, "ERROR", http.StatusInternalServerError)
+}
+
+// RedirectResource creates a resource and records the location at which
+// it will be stored, then redirects the client to a signed URL to upload
+// the file data to. Uploads to the dummy driver pass through
+// SignedResource, which records their size and expiry; for other drivers
+// the data never passes through this service, so the recorded size is
+// zero and expiry can't be applied.
+func RedirectResource(res http.ResponseWriter, req *http.Request, name string, expires time.Time) {
+	s, ok := Driver.Driver.(fsabstract.URLSigner)
+	if !ok {
+		http.Error(res, "Driver does not support signed URLs", http.StatusNotImplemented)
+		return
+	}
+	if _, dummy := Driver.Driver.(*fsabstract.FSDummy); !dummy && !expires.IsZero() {
+		http.Error(res, "ttl is not supported for redirected uploads", http.StatusBadRequest)
+		return
+	}
+	fsd, err := fsabstract.NewDescriptor(IdGenerator, name)
+	if err != nil {
+		log.Print(err)
+		http.Error(res, "ERROR", http.StatusInternalServerError)
+		return
+	}
+	fsd.Expires = expires
+	fsl, err := s.Locate(fsd)
+	if err == nil {
+		fsd.Location = append(fsd.Location, fsl)
+		err = Catalog.Save(fsd)
+	}
+	var u string
+	if err == nil {
+		u, err = s.SignURL(fsl, "PUT", *REDIRECT)
+	}
+	if err != nil {
+		log.Print(err)
+		http.Error(res, "ERROR", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(res, req, u, http.StatusTemporaryRedirect)
+}
+
+// SignedResource serves GET and PUT requests to URLs signed by the dummy
+// driver.
+func SignedResource(res http.ResponseWriter, req *http.Request) {
+	d, ok := Driver.Driver.(*fsabstract.FSDummy)
+	if !ok {
+		http.NotFound(res, req)
+		return
+	}
+	fsl, err := d.VerifyURL(req.Method, req.URL.Query())
+	if err != nil {
+		log.Print(err)
+		http.Error(res, err.Error(), http.StatusForbidden)
+		return
+	}
+	if req.Method == "PUT" {
+		// Write with the descriptor recorded by RedirectResource, so that
+		// its expiry and metadata are applied, then record the size
+		var fsd fsabstract.FileStoreDescriptor
+		id, err := d.LocationId(fsl)
+		if err == nil {
+			fsd, err = Catalog.Load(id)
+		}
+		if err == nil {
+			fsd, err = d.WriteLocation(fsd, fsl, req.Body)
+		}
+		if err == nil {
+			err = fsabstract.UpdateDescriptor(Catalog, id, func(dU fsabstract.FileStoreDescriptor) (fsabstract.FileStoreDescriptor, error) {
+				dU.Size = fsd.Size
+				return dU, nil
+			})
+		}
+		if err != nil {
+			log.Print(err)
+			http.Error(res, "ERROR", http.StatusInternalServerError)
+		}
+		return
+	}
+	data, _, err := d.Get(fsabstract.FileStoreDescriptor{Location: []fsabstract.FileStoreLocation{fsl}})
+	if err != nil {
+		log.Print(err)
+		http.NotFound(res, req)
+		return
+	}
+	res.Write(data)
 }
 
 func DeleteResource(params martini.Params) string {
 	log.Print("Got DELETE request")
-	return "OK"
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		log.Print(err)
+		return ""
+	}
+	var fsd fsabstract.FileStoreDescriptor
+	err = fsabstract.UpdateDescriptor(Catalog, id, func(d fsabstract.FileStoreDescriptor) (fsabstract.FileStoreDescriptor, error) {
+		var err error
+		fsd, err = Driver.Delete(d, fsabstract.FileStoreLocation{})
+		return fsd, err
+	})
+	if err != nil {
+		log.Print(err)
+		return ""
+	}
+	return fsd.ToString()
+}
+
+func UndeleteResource(params martini.Params) string {
+	log.Print("Got UNDELETE request")
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		log.Print(err)
+		return ""
+	}
+	var fsd fsabstract.FileStoreDescriptor
+	err = fsabstract.UpdateDescriptor(Catalog, id, func(d fsabstract.FileStoreDescriptor) (fsabstract.FileStoreDescriptor, error) {
+		fsd = d
+		for _, l := range d.Location {
+			if l.Driver == Driver.DriverName() && l.IsDeleted() {
+				var err error
+				fsd, err = Driver.Undelete(d, l)
+				return fsd, err
+			}
+		}
+		return fsd, nil
+	})
+	if err != nil {
+		log.Print(err)
+		return ""
+	}
+	return fsd.ToString()
 }
 
-func CreateResource(name string, data []byte) string {
+// LoadResource looks up a FileStoreDescriptor in the catalog by its Id.
+func LoadResource(id string) (fsabstract.FileStoreDescriptor, error) {
+	i, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		// No such resource can exist
+		return fsabstract.FileStoreDescriptor{}, fsabstract.ErrNotFound
+	}
+	return Catalog.Load(i)
+}
+
+func CreateResource(name string, data io.Reader, expires time.Time) string {
 	// Create a simple file store descriptor. We do this because this
 	// service is a simple implementation which does not support
 	// multiple locations. Ideally, the FileStoreDescriptor would be
 	// passed as part of the request, and a FileStoreLocation object
 	// would be added.
-	fsd := fsabstract.FileStoreDescriptor{
-		Id:      GlobalCounter,
-		Name:    name,
-		Size:    int64(len(data)),
-		Created: time.Now(),
+	fsd, err := fsabstract.NewDescriptor(IdGenerator, name)
+	if err != nil {
+		log.Print(err)
+		return "nil"
 	}
+	fsd.Expires = expires
 
-	fsd, err := Driver.Put(fsd, data)
+	fsd, err = Driver.PutReader(fsd, data)
 	if err != nil {
+		log.Print(err)
 		return "nil"
 	}
 
-	// Make sure to increment this. Horrible hack.
-	GlobalCounter++
+	err = Catalog.Save(fsd)
+	if err != nil {
+		log.Print(err)
+		return "nil"
+	}
 
 	return fsd.ToString()
 }
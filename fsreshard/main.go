@@ -0,0 +1,39 @@
+// Command fsreshard reorganizes the files of a dummy driver store, such as
+// one using the original flat layout, into a sharded directory layout.
+// Existing locations remain readable, so the catalog doesn't need to be
+// updated.
+//
+//	fsreshard -basepath ./store -depth 2
+package main
+
+import (
+	"flag"
+	fsabstract "github.com/jbuchbinder/fsabstract"
+	"log"
+	"strconv"
+)
+
+var (
+	BASEPATH = flag.String("basepath", "./store", "Base path of the dummy driver store")
+	DEPTH    = flag.Int("depth", 2, "Number of directory levels to shard files across (0 for flat)")
+)
+
+func main() {
+	flag.Parse()
+
+	d := new(fsabstract.FSDummy)
+	d.Configure(map[string]string{
+		"fs.dummy.basepath":   *BASEPATH,
+		"fs.dummy.shardDepth": strconv.Itoa(*DEPTH),
+	})
+	err := d.Initialize()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	n, err := d.Reshard()
+	log.Print("Moved " + strconv.Itoa(n) + " files")
+	if err != nil {
+		log.Fatal(err)
+	}
+}
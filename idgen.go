@@ -0,0 +1,47 @@
+package fsabstract
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// IdGeneratorMap is the internal id generator mapping. As with
+	// FileStoreDriverMap, generators register themselves here when declared
+	// so that they can be loaded by name.
+	IdGeneratorMap = map[string]func() IdGenerator{}
+)
+
+// IdGenerator produces unique FileStoreDescriptor Ids. Implementations must
+// be safe for concurrent use, and must not hand out the same Id twice,
+// including across restarts.
+type IdGenerator interface {
+	GeneratorName() string
+	Configure(map[string]string)
+	Initialize() error
+	NextId() (int64, error)
+}
+
+// NewDescriptor creates a FileStoreDescriptor with a freshly generated Id.
+func NewDescriptor(g IdGenerator, name string) (FileStoreDescriptor, error) {
+	id, err := g.NextId()
+	if err != nil {
+		return FileStoreDescriptor{}, err
+	}
+	return FileStoreDescriptor{
+		Id:      id,
+		Name:    name,
+		Created: time.Now(),
+	}, nil
+}
+
+func GetIdGenerator(generatorName string) IdGenerator {
+	g := strings.TrimSpace(generatorName)
+	if _, exists := IdGeneratorMap[g]; exists {
+		return IdGeneratorMap[g]()
+	} else {
+		fmt.Println("Unable to resolve id generator " + g)
+		return nil
+	}
+}
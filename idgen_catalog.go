@@ -0,0 +1,76 @@
+package fsabstract
+
+import (
+	"errors"
+	"sync"
+)
+
+// IGCatalog is an id generator backed by a named sequence in a descriptor
+// store which implements DescriptorSequencer. Since it needs an existing
+// store, it is created with NewCatalogIdGenerator rather than by name. On
+// first use the sequence is seeded past the highest Id already stored, so
+// catalogs populated by another generator don't hand out duplicates.
+type IGCatalog struct {
+	Sequence string `fsdconfig:"fs.idgen.catalog.sequence"`
+
+	store  DescriptorStore
+	lock   sync.Mutex
+	seeded bool
+}
+
+// NewCatalogIdGenerator creates an id generator which draws Ids from the
+// "descriptor" sequence of an initialized descriptor store.
+func NewCatalogIdGenerator(s DescriptorStore) *IGCatalog {
+	return &IGCatalog{
+		Sequence: "descriptor",
+		store:    s,
+	}
+}
+
+func (self *IGCatalog) GeneratorName() string {
+	return "catalog"
+}
+
+func (self *IGCatalog) Configure(c map[string]string) {
+	if v, exists := c["fs.idgen.catalog.sequence"]; exists {
+		self.Sequence = v
+	}
+}
+
+func (self *IGCatalog) Initialize() error {
+	if _, ok := self.store.(DescriptorSequencer); !ok {
+		return errors.New("Descriptor store " + self.store.StoreName() + " does not support sequences")
+	}
+	return nil
+}
+
+func (self *IGCatalog) NextId() (int64, error) {
+	if err := self.seed(); err != nil {
+		return 0, err
+	}
+	return self.store.(DescriptorSequencer).NextSequence(self.Sequence)
+}
+
+// seed raises the sequence to the highest stored Id, once per generator.
+func (self *IGCatalog) seed() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.seeded {
+		return nil
+	}
+	ds, err := self.store.Query(DescriptorQuery{})
+	if err != nil {
+		return err
+	}
+	var max int64
+	for _, d := range ds {
+		if d.Id > max {
+			max = d.Id
+		}
+	}
+	if err = self.store.(DescriptorSequencer).SeedSequence(self.Sequence, max); err != nil {
+		return err
+	}
+	self.seeded = true
+	return nil
+}
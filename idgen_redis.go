@@ -0,0 +1,56 @@
+package fsabstract
+
+func init() {
+	IdGeneratorMap["redis"] = func() IdGenerator {
+		return new(IGRedis)
+	}
+}
+
+// IGRedis is an id generator backed by a Redis counter, incremented with
+// INCR. It is shared by every process using the same server and key.
+type IGRedis struct {
+	Server string `fsdconfig:"fs.idgen.redis.server"`
+	Key    string `fsdconfig:"fs.idgen.redis.key"`
+
+	redis FSRedis
+}
+
+func (self *IGRedis) GeneratorName() string {
+	return "redis"
+}
+
+func (self *IGRedis) Configure(c map[string]string) {
+	if v, exists := c["fs.idgen.redis.server"]; exists {
+		self.Server = v
+	}
+	if v, exists := c["fs.idgen.redis.key"]; exists {
+		self.Key = v
+	}
+}
+
+func (self *IGRedis) Initialize() error {
+	if self.Key == "" {
+		self.Key = "fs_id"
+	}
+	self.redis = FSRedis{RwServer: self.Server}
+	return self.redis.Initialize()
+}
+
+func (self *IGRedis) NextId() (int64, error) {
+	var id int64
+	err := self.redis.write(self.Key, func(conn redisClient) error {
+		var err error
+		id, err = conn.Incr(self.Key)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// Close releases pooled Redis clients.
+func (self *IGRedis) Close() error {
+	return self.redis.Close()
+}
@@ -0,0 +1,109 @@
+package fsabstract
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	snowflakeNodeBits     = 10
+	snowflakeSequenceBits = 12
+	snowflakeMaxNode      = 1<<snowflakeNodeBits - 1
+	snowflakeSequenceMask = 1<<snowflakeSequenceBits - 1
+)
+
+var (
+	// DefaultSnowflakeEpoch is the epoch used by IGSnowflake unless one is
+	// configured. Changing the epoch of an existing deployment can cause
+	// Id collisions.
+	DefaultSnowflakeEpoch = time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+func init() {
+	IdGeneratorMap["snowflake"] = func() IdGenerator {
+		return new(IGSnowflake)
+	}
+}
+
+// IGSnowflake is a Snowflake-style id generator. Each Id is composed of 41
+// bits of milliseconds since the epoch, 10 bits of node Id and 12 bits of
+// per-millisecond sequence, so it requires no coordination as long as every
+// process is configured with a distinct node Id.
+type IGSnowflake struct {
+	NodeId int64     `fsdconfig:"fs.idgen.snowflake.node"`
+	Epoch  time.Time `fsdconfig:"fs.idgen.snowflake.epoch"`
+
+	lock     sync.Mutex
+	last     int64
+	sequence int64
+}
+
+func (self *IGSnowflake) GeneratorName() string {
+	return "snowflake"
+}
+
+func (self *IGSnowflake) Configure(c map[string]string) {
+	if v, exists := c["fs.idgen.snowflake.node"]; exists {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			panic("Unable to parse snowflake node " + v)
+		}
+		self.NodeId = n
+	}
+	if v, exists := c["fs.idgen.snowflake.epoch"]; exists {
+		e, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			panic("Unable to parse snowflake epoch " + v)
+		}
+		self.Epoch = e
+	}
+}
+
+func (self *IGSnowflake) Initialize() error {
+	if self.NodeId < 0 || self.NodeId > snowflakeMaxNode {
+		return errors.New("Snowflake node must be between 0 and " + strconv.Itoa(snowflakeMaxNode))
+	}
+	if self.Epoch.IsZero() {
+		self.Epoch = DefaultSnowflakeEpoch
+	}
+	if self.Epoch.After(time.Now()) {
+		return errors.New("Snowflake epoch is in the future")
+	}
+	return nil
+}
+
+func (self *IGSnowflake) NextId() (int64, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := self.millis()
+	if now < self.last {
+		// Tolerate small clock adjustments by waiting them out
+		if self.last-now > 1000 {
+			return 0, errors.New("Clock moved backwards by " + strconv.FormatInt(self.last-now, 10) + "ms")
+		}
+		time.Sleep(time.Duration(self.last-now) * time.Millisecond)
+		now = self.millis()
+	}
+	if now == self.last {
+		self.sequence = (self.sequence + 1) & snowflakeSequenceMask
+		if self.sequence == 0 {
+			// Sequence exhausted for this millisecond
+			for now <= self.last {
+				time.Sleep(100 * time.Microsecond)
+				now = self.millis()
+			}
+		}
+	} else {
+		self.sequence = 0
+	}
+	self.last = now
+
+	return now<<(snowflakeNodeBits+snowflakeSequenceBits) | self.NodeId<<snowflakeSequenceBits | self.sequence, nil
+}
+
+func (self *IGSnowflake) millis() int64 {
+	return int64(time.Since(self.Epoch) / time.Millisecond)
+}
@@ -0,0 +1,103 @@
+package fsabstract
+
+import (
+	miniredis "github.com/alicebob/miniredis/v2"
+	"testing"
+)
+
+func TestSnowflakeIdGenerator(t *testing.T) {
+	t.Log("Testing snowflake id generator")
+
+	g := GetIdGenerator("snowflake")
+	if g == nil {
+		t.Fatal("Unable to instantiate snowflake id generator")
+	}
+	g.Configure(map[string]string{"fs.idgen.snowflake.node": "7"})
+	err := g.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough Ids to exhaust the per-millisecond sequence at least once
+	seen := map[int64]bool{}
+	var last int64
+	for i := 0; i < 10000; i++ {
+		id, err := g.NextId()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[id] {
+			t.Fatalf("Duplicate id %d", id)
+		}
+		if id <= last {
+			t.Fatalf("Id %d not greater than previous id %d", id, last)
+		}
+		if (id>>snowflakeSequenceBits)&snowflakeMaxNode != 7 {
+			t.Fatalf("Id %d does not encode node 7", id)
+		}
+		seen[id] = true
+		last = id
+	}
+
+	t.Log("Invalid node")
+	g = GetIdGenerator("snowflake")
+	g.Configure(map[string]string{"fs.idgen.snowflake.node": "1024"})
+	if g.Initialize() == nil {
+		t.Error("Initialize() accepted out of range node")
+	}
+}
+
+func TestCatalogIdGenerator(t *testing.T) {
+	t.Log("Testing catalog id generator")
+
+	s := GetDescriptorStore("memory")
+	s.Initialize()
+	g := NewCatalogIdGenerator(s)
+	err := g.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewDescriptor(g, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Id != 1 || d.Name != "a.txt" || d.Created.IsZero() {
+		t.Error("Unexpected descriptor : " + d.ToString())
+	}
+	d, err = NewDescriptor(g, "b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Id != 2 {
+		t.Errorf("Second id was %d, expected 2", d.Id)
+	}
+
+	t.Log("Seeding from stored Ids")
+	s = GetDescriptorStore("memory")
+	s.Initialize()
+	s.Save(FileStoreDescriptor{Id: 41})
+	g = NewCatalogIdGenerator(s)
+	g.Initialize()
+	if id, err := g.NextId(); err != nil || id != 42 {
+		t.Errorf("First id with stored descriptors was %d, %v", id, err)
+	}
+}
+
+func TestRedisIdGenerator(t *testing.T) {
+	s := miniredis.RunT(t)
+	g := GetIdGenerator("redis")
+	g.Configure(map[string]string{"fs.idgen.redis.server": "redis://" + s.Addr() + "/0"})
+	if err := g.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer g.(*IGRedis).Close()
+	for i := int64(1); i <= 2; i++ {
+		if id, err := g.NextId(); err != nil || id != i {
+			t.Errorf("NextId() returned %d, %v", id, err)
+		}
+	}
+	if v, _ := s.Get("fs_id"); v != "2" {
+		t.Errorf("Counter was %q", v)
+	}
+}
@@ -0,0 +1,190 @@
+package fsabstract
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultKeyPrefix is the prefix of keys built by SafeKeyNamer.
+	DefaultKeyPrefix = "fs_"
+	// DefaultKeyMaxLength is the default maximum key length, which is the
+	// memcache limit.
+	DefaultKeyMaxLength = 250
+
+	// keyHashLength is the number of hex digits of the name hash appended
+	// to shortened keys.
+	keyHashLength = 16
+)
+
+var (
+	// KeyNamerMap is the internal key naming strategy mapping, used by the
+	// memcache, redis and s3 drivers to build keys for new file data. The
+	// strategy is chosen with the fs.<driver>.keyNaming configuration key.
+	KeyNamerMap = map[string]func() KeyNamer{
+		"legacy": func() KeyNamer {
+			return new(LegacyKeyNamer)
+		},
+		"safe": func() KeyNamer {
+			return new(SafeKeyNamer)
+		},
+	}
+)
+
+// KeyNamer builds the key under which a driver stores file data. Keys are
+// recorded in FileStoreLocation.Location, so changing the strategy only
+// affects file data stored afterwards.
+type KeyNamer interface {
+	// Configure reads strategy settings from keys starting with prefix,
+	// for example "fs.redis.".
+	Configure(prefix string, c map[string]string)
+	Key(FileStoreDescriptor) string
+}
+
+// KeyPrefixer is implemented by key namers whose keys all start with a
+// fixed prefix, so that drivers are able to list the keys they built.
+type KeyPrefixer interface {
+	KeyPrefix() string
+}
+
+func GetKeyNamer(namerName string) KeyNamer {
+	n := strings.TrimSpace(namerName)
+	if _, exists := KeyNamerMap[n]; exists {
+		return KeyNamerMap[n]()
+	} else {
+		fmt.Println("Unable to resolve key namer " + n)
+		return nil
+	}
+}
+
+// newKeyNamer resolves and configures the key naming strategy for a
+// driver, defaulting to "safe".
+func newKeyNamer(namerName, prefix string, c map[string]string) (KeyNamer, error) {
+	if namerName == "" {
+		namerName = "safe"
+	}
+	if _, exists := KeyNamerMap[namerName]; !exists {
+		return nil, errors.New("Unable to resolve key namer " + namerName)
+	}
+	n := KeyNamerMap[namerName]()
+	n.Configure(prefix, c)
+	return n, nil
+}
+
+// LegacyKeyNamer builds keys as "fs_<hex id>_<name>", as drivers did before
+// key naming was configurable. Names are used verbatim.
+type LegacyKeyNamer struct{}
+
+func (self *LegacyKeyNamer) Configure(prefix string, c map[string]string) {
+}
+
+func (self *LegacyKeyNamer) KeyPrefix() string {
+	return "fs_"
+}
+
+func (self *LegacyKeyNamer) Key(d FileStoreDescriptor) string {
+	return "fs_" + strconv.FormatInt(d.Id, 16) + "_" + d.Name
+}
+
+// SafeKeyNamer builds keys as "<prefix>[<date>/]<hex id>_<escaped name>".
+// Bytes of the name other than ASCII letters, digits, '.', '-' and '_' are
+// percent escaped, so keys never contain spaces, slashes or control
+// characters. Keys longer than MaxLength have the name shortened and a hash
+// of the full name appended. Should the prefix, date and id not fit either,
+// the key is cut short with a hash of all of it appended. If DateLayout is set, the creation date of the
+// file, in UTC and formatted with that layout, partitions the keys.
+//
+// Settings are read from the <prefix>keyPrefix, <prefix>keyMaxLength and
+// <prefix>keyDateLayout configuration keys.
+type SafeKeyNamer struct {
+	Prefix     string
+	MaxLength  int
+	DateLayout string
+}
+
+func (self *SafeKeyNamer) Configure(prefix string, c map[string]string) {
+	if v, exists := c[prefix+"keyPrefix"]; exists {
+		self.Prefix = v
+	} else {
+		self.Prefix = DefaultKeyPrefix
+	}
+	if v, exists := c[prefix+"keyMaxLength"]; exists {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			panic("Unable to parse key max length " + v)
+		}
+		self.MaxLength = n
+	}
+	if v, exists := c[prefix+"keyDateLayout"]; exists {
+		self.DateLayout = v
+	}
+}
+
+func (self *SafeKeyNamer) KeyPrefix() string {
+	return self.Prefix
+}
+
+func (self *SafeKeyNamer) Key(d FileStoreDescriptor) string {
+	head := self.Prefix
+	if self.DateLayout != "" {
+		created := d.Created
+		if created.IsZero() {
+			created = time.Now()
+		}
+		head += created.UTC().Format(self.DateLayout) + "/"
+	}
+	head += strconv.FormatInt(d.Id, 16) + "_"
+
+	name := escapeKeyName(d.Name)
+	max := self.MaxLength
+	if max <= 0 {
+		max = DefaultKeyMaxLength
+	}
+	if len(head)+len(name) <= max {
+		return head + name
+	}
+
+	sum := sha256.Sum256([]byte(d.Name))
+	hash := hex.EncodeToString(sum[:])[:keyHashLength]
+	keep := max - len(head) - len(hash) - 1
+	if keep < 0 {
+		// The id must still tell keys apart once the head is cut
+		sum = sha256.Sum256([]byte(head + name))
+		hash = hex.EncodeToString(sum[:])[:keyHashLength]
+		keep = max - len(hash) - 1
+		if keep < 0 {
+			return hash[:max]
+		}
+		return head[:keep] + "_" + hash
+	}
+	if keep > len(name) {
+		keep = len(name)
+	}
+	// Don't split an escape sequence
+	if i := strings.LastIndexByte(name[:keep], '%'); i >= 0 && i+3 > keep {
+		keep = i
+	}
+	return head + name[:keep] + "_" + hash
+}
+
+// escapeKeyName percent escapes every byte of a name which is not an ASCII
+// letter, digit, '.', '-' or '_'.
+func escapeKeyName(name string) string {
+	const hexDigits = "0123456789ABCDEF"
+	b := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '-', c == '_':
+			b = append(b, c)
+		default:
+			b = append(b, '%', hexDigits[c>>4], hexDigits[c&15])
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,61 @@
+package fsabstract
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyNamers(t *testing.T) {
+	d := FileStoreDescriptor{Id: 255, Name: "my file/ü.txt", Created: time.Date(2014, 3, 1, 12, 0, 0, 0, time.UTC)}
+
+	if k := GetKeyNamer("legacy").Key(d); k != "fs_ff_my file/ü.txt" {
+		t.Errorf("Legacy key was %s", k)
+	}
+
+	n, err := newKeyNamer("", "fs.test.", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k := n.Key(d); k != "fs_ff_my%20file%2F%C3%BC.txt" {
+		t.Errorf("Safe key was %s", k)
+	}
+
+	n, err = newKeyNamer("safe", "fs.test.", map[string]string{
+		"fs.test.keyPrefix":     "files/",
+		"fs.test.keyDateLayout": "2006/01/02",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k := n.Key(d); k != "files/2014/03/01/ff_my%20file%2F%C3%BC.txt" {
+		t.Errorf("Partitioned key was %s", k)
+	}
+
+	// Long names are shortened, keeping distinct names distinct
+	d.Name = strings.Repeat("ü", 200) + "a"
+	k1 := n.Key(d)
+	d.Name = strings.Repeat("ü", 200) + "b"
+	k2 := n.Key(d)
+	if len(k1) > DefaultKeyMaxLength || len(k2) > DefaultKeyMaxLength || k1 == k2 {
+		t.Errorf("Long keys were %s and %s", k1, k2)
+	}
+	if strings.Contains(k1, "%_") || strings.Contains(k1, "%C_") {
+		t.Errorf("Long key %s splits an escape", k1)
+	}
+
+	// A prefix longer than the limit is shortened too
+	n = &SafeKeyNamer{Prefix: strings.Repeat("p", 300), MaxLength: 64}
+	k1 = n.Key(FileStoreDescriptor{Id: 1, Name: "a"})
+	k2 = n.Key(FileStoreDescriptor{Id: 2, Name: "a"})
+	if len(k1) > 64 || len(k2) > 64 || k1 == k2 || !strings.HasPrefix(k1, "ppp") {
+		t.Errorf("Keys with a long prefix were %s and %s", k1, k2)
+	}
+	if k := (&SafeKeyNamer{Prefix: "files/", MaxLength: 8}).Key(d); len(k) > 8 {
+		t.Errorf("Key %s exceeds a limit shorter than its hash", k)
+	}
+
+	if _, err = newKeyNamer("unknown", "fs.test.", nil); err == nil {
+		t.Error("Expected unknown key namer to be rejected")
+	}
+}
@@ -4,34 +4,49 @@ import (
 	"errors"
 )
 
-func Migrate(f FileStoreDescriptor, locFrom, locTo FileStoreLocation) (FileStoreDescriptor, error) {
-	// Migrate file described by f from one location to another
+// Migrate moves the file data described by f from one location to another,
+// returning the descriptor with the new location in place of the old. The
+// drivers holding each location are given configured and initialized, and
+// must be the ones named by the locations. The data is stored in the store
+// named by locTo.Id, for drivers which implement FileStoreStorePutter, and
+// otherwise wherever the destination driver puts it. Migrating to the
+// source location fails with ErrSameLocation, leaving the source in place.
+func Migrate(dFrom, dTo FileStoreDriver, f FileStoreDescriptor, locFrom, locTo FileStoreLocation) (FileStoreDescriptor, error) {
 	fU := f
-
-	// Retrieve drivers
-	dFrom := GetDriver(locFrom.Driver)
-	if dFrom == nil {
-		return fU, errors.New("Could not instantiate driver " + locFrom.Driver)
+	if dFrom == nil || dFrom.DriverName() != locFrom.Driver {
+		return fU, errors.New("Driver " + locFrom.Driver + " not given for " + locFrom.ToString())
+	}
+	if dTo == nil || dTo.DriverName() != locTo.Driver {
+		return fU, errors.New("Driver " + locTo.Driver + " not given for " + locTo.ToString())
 	}
-	dTo := GetDriver(locTo.Driver)
-	if dTo == nil {
-		return fU, errors.New("Could not instantiate driver " + locTo.Driver)
+	if locTo.Driver == locFrom.Driver && locTo.Id == locFrom.Id && (locTo.Location == "" || locTo.Location == locFrom.Location) {
+		return fU, ErrSameLocation
 	}
 
 	// Get file data
-	content, originalLocation, err := dFrom.Get(fU)
+	content, err := GetFrom(dFrom, fU, locFrom)
 	if err != nil {
 		return fU, err
 	}
 
 	// Put to destination driver
-	fU, err = dTo.Put(fU, content)
+	if p, ok := dTo.(FileStoreStorePutter); ok && locTo.Id != "" {
+		fU, err = p.PutTo(fU, locTo.Id, content)
+	} else {
+		fU, err = dTo.Put(fU, content)
+	}
 	if err != nil {
 		return fU, err
 	}
 
+	// The destination turned out to be the source, which now holds the
+	// data just written, so it must not be deleted
+	if l := fU.Location[len(fU.Location)-1]; l.Key() == locFrom.Key() {
+		return fU, ErrSameLocation
+	}
+
 	// Remove from source
-	fU, err = dFrom.Delete(fU, originalLocation)
+	fU, err = dFrom.Delete(fU, locFrom)
 	if err != nil {
 		return fU, err
 	}
@@ -0,0 +1,23 @@
+package fsabstract
+
+// redisClient is the subset of Redis commands used by FSRedis and IGRedis.
+// It is satisfied by respClient.
+type redisClient interface {
+	Get(key string) ([]byte, error)
+	// Set stores a string, expiring it after seconds if that is positive.
+	Set(key string, value []byte, seconds int64) error
+	Del(key string) (bool, error)
+	Rename(key, newKey string) error
+	Expire(key string, seconds int64) (bool, error)
+	Incr(key string) (int64, error)
+	Hget(key, field string) ([]byte, error)
+	Hkeys(key string) ([]string, error)
+	// Hmget returns the values of those fields which are set.
+	Hmget(key string, fields ...string) (map[string][]byte, error)
+	// Hreplace replaces a hash with fields in a single transaction,
+	// expiring it after seconds if that is positive.
+	Hreplace(key string, fields map[string][]byte, seconds int64) error
+	Scan(cursor, match string) (string, []string, error)
+	Ping() error
+	Quit() error
+}
@@ -0,0 +1,277 @@
+package fsabstract
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	redisClusterSlots = 16384
+)
+
+// redisCluster routes commands to the nodes of a Redis Cluster, based on
+// the hash slot of the key being accessed. The slot map is loaded with
+// CLUSTER SLOTS, and refreshed whenever a node moves a slot or reports the
+// cluster down. Requests for a slot part way through migrating are sent on
+// to the node named by the ASK reply, leaving the slot map alone.
+type redisCluster struct {
+	seeds  []string
+	driver *FSRedis
+
+	lock  sync.RWMutex
+	slots [redisClusterSlots]string
+	pools map[string]*redisPool
+}
+
+func newRedisCluster(seeds []string, driver *FSRedis) *redisCluster {
+	return &redisCluster{
+		seeds:  seeds,
+		driver: driver,
+		pools:  map[string]*redisPool{},
+	}
+}
+
+// refresh reloads the slot map from the first seed which answers.
+func (self *redisCluster) refresh() error {
+	var lastErr error
+	for _, seed := range self.seeds {
+		c, err := self.driver.parseRedisUrl(seed)
+		if err != nil {
+			return err
+		}
+		reply, err := respCommand(c, "CLUSTER", "SLOTS")
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return self.load(seed, c.host, reply)
+	}
+	if lastErr == nil {
+		lastErr = errors.New("No redis cluster nodes configured")
+	}
+	return lastErr
+}
+
+// load replaces the slot map with a CLUSTER SLOTS reply, creating pools for
+// new nodes and closing pools for nodes which no longer own any slots.
+func (self *redisCluster) load(seed, seedHost string, reply interface{}) error {
+	ranges, ok := reply.([]interface{})
+	if !ok {
+		return errors.New("Unexpected CLUSTER SLOTS reply")
+	}
+
+	var slots [redisClusterSlots]string
+	nodes := map[string]bool{}
+	for _, v := range ranges {
+		r, ok := v.([]interface{})
+		if !ok || len(r) < 3 {
+			return errors.New("Unexpected CLUSTER SLOTS entry")
+		}
+		start, _ := r[0].(int64)
+		end, _ := r[1].(int64)
+		master, ok := r[2].([]interface{})
+		if !ok || len(master) < 2 {
+			return errors.New("Unexpected CLUSTER SLOTS node")
+		}
+		host := respString(master[0])
+		if host == "" {
+			// An empty host means "the node you asked"
+			host = seedHost
+		}
+		addr := net.JoinHostPort(host, respString(master[1]))
+		nodes[addr] = true
+		for i := start; i <= end && i < redisClusterSlots; i++ {
+			slots[i] = addr
+		}
+	}
+
+	// Create pools for new nodes before taking the lock
+	self.lock.RLock()
+	added := map[string]*redisPool{}
+	for addr := range nodes {
+		if _, exists := self.pools[addr]; !exists {
+			added[addr] = nil
+		}
+	}
+	self.lock.RUnlock()
+	for addr := range added {
+		p, err := self.driver.newPool(redisUrlWithHost(seed, addr))
+		if err != nil {
+			for _, v := range added {
+				if v != nil {
+					v.close()
+				}
+			}
+			return err
+		}
+		added[addr] = p
+	}
+
+	self.lock.Lock()
+	self.slots = slots
+	stale := make([]*redisPool, 0)
+	for addr, p := range self.pools {
+		if !nodes[addr] {
+			stale = append(stale, p)
+			delete(self.pools, addr)
+		}
+	}
+	for addr, p := range added {
+		if _, exists := self.pools[addr]; exists {
+			// Added by a concurrent refresh
+			stale = append(stale, p)
+			continue
+		}
+		self.pools[addr] = p
+	}
+	self.lock.Unlock()
+
+	for _, p := range stale {
+		p.close()
+	}
+	return nil
+}
+
+func (self *redisCluster) pool(key string) *redisPool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.pools[self.slots[redisClusterSlot(key)]]
+}
+
+// do runs fn against the node which owns key. If the node redirects the
+// request, it is retried once, against the node named by an ASK reply, or
+// against the owner of the key after refreshing the slot map.
+func (self *redisCluster) do(key string, fn func(redisClient) error) error {
+	p := self.pool(key)
+	if p == nil {
+		err := self.refresh()
+		if err != nil {
+			return err
+		}
+		p = self.pool(key)
+		if p == nil {
+			return errors.New("No redis cluster node serves key " + key)
+		}
+	}
+
+	err := p.do(fn)
+	if addr, ask := redisClusterAsk(err); ask {
+		return self.ask(addr, fn)
+	}
+	if err != nil && redisClusterRedirect(err) {
+		log.Print("Redis cluster redirect, refreshing slots : " + err.Error())
+		if rerr := self.refresh(); rerr != nil {
+			return err
+		}
+		p = self.pool(key)
+		if p == nil {
+			return err
+		}
+		err = p.do(fn)
+	}
+	return err
+}
+
+// ask runs fn against the node named by an ASK redirect, preceding each
+// command with ASKING. Nodes outside the slot map are only connected to for
+// the request.
+func (self *redisCluster) ask(addr string, fn func(redisClient) error) error {
+	self.lock.RLock()
+	p := self.pools[addr]
+	self.lock.RUnlock()
+	if p == nil {
+		var err error
+		p, err = self.driver.newPool(redisUrlWithHost(self.seeds[0], addr))
+		if err != nil {
+			return err
+		}
+		defer p.close()
+	}
+	return p.do(func(c redisClient) error {
+		if rc, ok := c.(*respClient); ok {
+			rc.asking = true
+			defer func() { rc.asking = false }()
+		}
+		return fn(c)
+	})
+}
+
+// nodes returns the pools for every master node.
+func (self *redisCluster) nodes() []*redisPool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	l := make([]*redisPool, 0, len(self.pools))
+	for _, p := range self.pools {
+		l = append(l, p)
+	}
+	return l
+}
+
+func (self *redisCluster) close() error {
+	self.lock.Lock()
+	pools := self.pools
+	self.pools = map[string]*redisPool{}
+	self.lock.Unlock()
+
+	var err error
+	for _, p := range pools {
+		if perr := p.close(); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// redisClusterRedirect determines whether an error means that the slot map
+// is out of date.
+func redisClusterRedirect(err error) bool {
+	m := err.Error()
+	return strings.Contains(m, "MOVED ") || strings.Contains(m, "CLUSTERDOWN")
+}
+
+// redisClusterAsk returns the node named by an ASK redirect, as
+// "ASK <slot> <host>:<port>".
+func redisClusterAsk(err error) (string, bool) {
+	if err == nil {
+		return "", false
+	}
+	m := err.Error()
+	n := strings.Index(m, "ASK ")
+	if n < 0 || (n > 0 && m[n-1] != ' ') {
+		return "", false
+	}
+	f := strings.Fields(m[n:])
+	if len(f) < 3 {
+		return "", false
+	}
+	return f[2], true
+}
+
+// redisClusterSlot returns the hash slot for a key, honoring {hash tags}.
+func redisClusterSlot(key string) int {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return int(crc16([]byte(key)) % redisClusterSlots)
+}
+
+// crc16 implements CRC16-CCITT (XMODEM), as used by Redis Cluster.
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, v := range b {
+		crc ^= uint16(v) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,319 @@
+package fsabstract
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeRedisNode is a RESP server whose replies come from handler, which
+// returns them already encoded. It records the commands it receives.
+type fakeRedisNode struct {
+	net.Listener
+	handler func(*fakeRedisNode, []string) string
+
+	lock     sync.Mutex
+	commands []string
+}
+
+func newFakeRedisNode(t *testing.T, handler func(*fakeRedisNode, []string) string) *fakeRedisNode {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &fakeRedisNode{Listener: l, handler: handler}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go n.serve(conn)
+		}
+	}()
+	return n
+}
+
+func (self *fakeRedisNode) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		v, err := respRead(r)
+		if err != nil {
+			return
+		}
+		req, _ := v.([]interface{})
+		args := make([]string, len(req))
+		for i := range req {
+			args[i] = respString(req[i])
+		}
+		if len(args) == 0 {
+			return
+		}
+		self.lock.Lock()
+		self.commands = append(self.commands, args[0])
+		self.lock.Unlock()
+		if args[0] == "QUIT" {
+			conn.Write([]byte("+OK\r\n"))
+			return
+		}
+		conn.Write([]byte(self.handler(self, args)))
+	}
+}
+
+// received determines whether the node was sent a command.
+func (self *fakeRedisNode) received(command string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, v := range self.commands {
+		if v == command {
+			return true
+		}
+	}
+	return false
+}
+
+// count returns the number of times the node was sent a command.
+func (self *fakeRedisNode) count(command string) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	n := 0
+	for _, v := range self.commands {
+		if v == command {
+			n++
+		}
+	}
+	return n
+}
+
+// sent returns the commands the node received, in order.
+func (self *fakeRedisNode) sent() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]string(nil), self.commands...)
+}
+
+func respBulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+// fakeClusterSlots encodes a CLUSTER SLOTS reply giving every slot to addr.
+func fakeClusterSlots(addr string) string {
+	host, port, _ := net.SplitHostPort(addr)
+	return "*1\r\n*3\r\n:0\r\n:16383\r\n*2\r\n" + respBulk(host) + ":" + port + "\r\n"
+}
+
+func TestRedisClusterSlot(t *testing.T) {
+	if v := crc16([]byte("123456789")); v != 0x31C3 {
+		t.Fatalf("crc16 = %x, expected 31c3", v)
+	}
+	if v := redisClusterSlot("foo"); v != 12182 {
+		t.Fatalf("Slot for foo = %d, expected 12182", v)
+	}
+	// Keys sharing a hash tag must share a slot
+	if redisClusterSlot(trashPrefix+"{foo}") != redisClusterSlot("foo") {
+		t.Fatal("Trashed key does not share the slot of the original key")
+	}
+	if redisClusterSlot("{}foo") != int(crc16([]byte("{}foo"))%redisClusterSlots) {
+		t.Fatal("Empty hash tag should hash the whole key")
+	}
+}
+
+func TestRedisTrashKey(t *testing.T) {
+	for _, k := range []string{"foo", "{user1}foo", "{x}", "a{b}c", "fs/1/2"} {
+		trashed := redisTrashKey(k)
+		if redisClusterSlot(trashed) != redisClusterSlot(k) {
+			t.Errorf("Trashed key %s changed slot", trashed)
+		}
+		if v := redisRestoredKey(trashed); v != k {
+			t.Errorf("Restored %s to %s, expected %s", trashed, v, k)
+		}
+	}
+	if redisTrashKey("{x}") == redisTrashKey("x") {
+		t.Error("Keys differing only by braces share a trashed key")
+	}
+}
+
+func TestRedisClusterLoad(t *testing.T) {
+	seed := "redis://seed:7000/0"
+	c := newRedisCluster([]string{seed}, new(FSRedis))
+	node := func(host string, port int64) []interface{} {
+		return []interface{}{[]byte(host), port}
+	}
+	err := c.load(seed, "seed", []interface{}{
+		[]interface{}{int64(0), int64(8191), node("10.0.0.1", 7000)},
+		// An empty host is the node which was asked
+		[]interface{}{int64(8192), int64(16383), node("", 7001), node("10.0.0.2", 7001)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.slots[0] != "10.0.0.1:7000" || c.slots[8191] != "10.0.0.1:7000" || c.slots[16383] != "seed:7001" || len(c.nodes()) != 2 {
+		t.Fatalf("Loaded slots %s, %s, %s from %d nodes", c.slots[0], c.slots[8191], c.slots[16383], len(c.nodes()))
+	}
+
+	// Nodes which no longer own slots are dropped
+	err = c.load(seed, "seed", []interface{}{
+		[]interface{}{int64(0), int64(16383), node("10.0.0.1", 7000)},
+	})
+	if err != nil || len(c.nodes()) != 1 || c.slots[16383] != "10.0.0.1:7000" {
+		t.Errorf("Reload left %d nodes, %v", len(c.nodes()), err)
+	}
+
+	if c.load(seed, "seed", []interface{}{[]interface{}{int64(0)}}) == nil {
+		t.Error("Malformed CLUSTER SLOTS reply accepted")
+	}
+}
+
+func TestRedisClusterRedirect(t *testing.T) {
+	var lock sync.Mutex
+	moved := false
+	b := newFakeRedisNode(t, func(n *fakeRedisNode, args []string) string {
+		switch args[0] {
+		case "CLUSTER":
+			return fakeClusterSlots(n.Addr().String())
+		case "GET":
+			return respBulk("b")
+		}
+		return "+OK\r\n"
+	})
+	bAddr := b.Addr().String()
+	a := newFakeRedisNode(t, func(n *fakeRedisNode, args []string) string {
+		lock.Lock()
+		defer lock.Unlock()
+		switch args[0] {
+		case "CLUSTER":
+			if moved {
+				return fakeClusterSlots(bAddr)
+			}
+			return fakeClusterSlots(n.Addr().String())
+		case "GET":
+			if moved {
+				return "-MOVED 12182 " + bAddr + "\r\n"
+			}
+			return respBulk("a")
+		}
+		return "+OK\r\n"
+	})
+
+	d := new(FSRedis)
+	d.Configure(map[string]string{
+		"fs.redis.mode":         REDIS_MODE_CLUSTER,
+		"fs.redis.clusterNodes": "redis://" + a.Addr().String() + "/0",
+	})
+	if err := d.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	fsd, err := d.Put(FileStoreDescriptor{Id: 1}, []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _, err := d.Get(fsd); err != nil || string(c) != "a" {
+		t.Fatalf("Get returned %q, %v", c, err)
+	}
+
+	// A MOVED reply reloads the slot map and retries against the new owner
+	lock.Lock()
+	moved = true
+	lock.Unlock()
+	if c, _, err := d.Get(fsd); err != nil || string(c) != "b" {
+		t.Errorf("Get after MOVED returned %q, %v", c, err)
+	}
+	if !b.received("GET") {
+		t.Error("Request not retried against the new owner")
+	}
+}
+
+func TestRedisClusterRefresh(t *testing.T) {
+	n := newFakeRedisNode(t, func(n *fakeRedisNode, args []string) string {
+		switch args[0] {
+		case "CLUSTER":
+			return fakeClusterSlots(n.Addr().String())
+		case "SELECT":
+			return "-ERR SELECT is not allowed in cluster mode\r\n"
+		case "GET":
+			return respBulk("data")
+		}
+		return "+OK\r\n"
+	})
+
+	d := new(FSRedis)
+	d.Configure(map[string]string{
+		"fs.redis.mode":         REDIS_MODE_CLUSTER,
+		"fs.redis.clusterNodes": "redis://" + n.Addr().String(),
+	})
+	if err := d.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if p := d.cluster.pool("foo"); p == nil || len(d.cluster.nodes()) != 1 {
+		t.Fatalf("Refresh loaded %d nodes", len(d.cluster.nodes()))
+	}
+	fsd, err := d.Put(FileStoreDescriptor{Id: 1}, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _, err := d.Get(fsd); err != nil || string(c) != "data" {
+		t.Errorf("Get returned %q, %v", c, err)
+	}
+	if n.received("SELECT") {
+		t.Error("SELECT sent to a cluster node")
+	}
+
+	d = &FSRedis{Mode: REDIS_MODE_CLUSTER, ClusterNodeList: []string{"redis://" + n.Addr().String() + "/2"}}
+	if d.Initialize() == nil {
+		t.Error("Cluster node with db 2 accepted")
+	}
+}
+
+func TestRedisClusterAsk(t *testing.T) {
+	b := newFakeRedisNode(t, func(n *fakeRedisNode, args []string) string {
+		if args[0] == "GET" {
+			return respBulk("b")
+		}
+		return "+OK\r\n"
+	})
+	a := newFakeRedisNode(t, func(n *fakeRedisNode, args []string) string {
+		switch args[0] {
+		case "CLUSTER":
+			return fakeClusterSlots(n.Addr().String())
+		case "GET":
+			return "-ASK 12182 " + b.Addr().String() + "\r\n"
+		}
+		return "+OK\r\n"
+	})
+
+	d := new(FSRedis)
+	d.Configure(map[string]string{
+		"fs.redis.mode":         REDIS_MODE_CLUSTER,
+		"fs.redis.clusterNodes": "redis://" + a.Addr().String() + "/0",
+	})
+	if err := d.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// An ASK reply sends the request on to the importing node, preceded by
+	// ASKING, and leaves the slot map alone
+	fsd, err := d.Put(FileStoreDescriptor{Id: 1}, []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _, err := d.Get(fsd); err != nil || string(c) != "b" {
+		t.Fatalf("Get after ASK returned %q, %v", c, err)
+	}
+	if sent := b.sent(); len(sent) < 2 || sent[0] != "ASKING" || sent[1] != "GET" {
+		t.Errorf("Importing node was sent %v", sent)
+	}
+	if n := a.count("CLUSTER"); n != 1 {
+		t.Errorf("Slot map loaded %d times", n)
+	}
+	if d.cluster.pool("foo") == nil || len(d.cluster.nodes()) != 1 {
+		t.Errorf("Slot map changed to %d nodes", len(d.cluster.nodes()))
+	}
+}
@@ -0,0 +1,174 @@
+package fsabstract
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// redisMetaPrefix prefixes FileStoreDescriptor.Metadata hash fields.
+	redisMetaPrefix = "meta."
+)
+
+// redisHashFields describes a file in hash storage.
+func redisHashFields(d FileStoreDescriptor, l FileStoreLocation, c []byte) map[string][]byte {
+	sum := sha256.Sum256(c)
+	f := map[string][]byte{
+		"content":  c,
+		"id":       []byte(strconv.FormatInt(d.Id, 10)),
+		"name":     []byte(d.Name),
+		"type":     []byte(d.Type),
+		"size":     []byte(strconv.Itoa(len(c))),
+		"created":  []byte(d.Created.Format(time.RFC3339Nano)),
+		"stored":   []byte(l.Created.Format(time.RFC3339Nano)),
+		"checksum": []byte("sha256:" + hex.EncodeToString(sum[:])),
+	}
+	if !d.Expires.IsZero() {
+		f["expires"] = []byte(d.Expires.Format(time.RFC3339Nano))
+	}
+	for k, v := range d.Metadata {
+		f[redisMetaPrefix+k] = []byte(v)
+	}
+	return f
+}
+
+// redisHashDescriptor rebuilds the descriptor of a file in hash storage.
+func redisHashDescriptor(f map[string][]byte) FileStoreDescriptor {
+	d := FileStoreDescriptor{
+		Name: string(f["name"]),
+		Type: string(f["type"]),
+	}
+	d.Id, _ = strconv.ParseInt(string(f["id"]), 10, 64)
+	d.Size, _ = strconv.ParseInt(string(f["size"]), 10, 64)
+	d.Created, _ = time.Parse(time.RFC3339Nano, string(f["created"]))
+	if v, exists := f["expires"]; exists {
+		d.Expires, _ = time.Parse(time.RFC3339Nano, string(v))
+	}
+	for k, v := range f {
+		if strings.HasPrefix(k, redisMetaPrefix) {
+			if d.Metadata == nil {
+				d.Metadata = map[string]string{}
+			}
+			d.Metadata[strings.TrimPrefix(k, redisMetaPrefix)] = string(v)
+		}
+	}
+	return d
+}
+
+// redisContent reads the content of a file, whichever way it was stored.
+// The storage setting is tried first, falling back to the other on a
+// WRONGTYPE error.
+func redisContent(conn redisClient, key, storage string) ([]byte, error) {
+	hash := storage == REDIS_STORAGE_HASH
+	for i := 0; ; i++ {
+		var c []byte
+		var err error
+		if hash {
+			c, err = conn.Hget(key, "content")
+		} else {
+			c, err = conn.Get(key)
+		}
+		if err == nil || i > 0 || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+			return c, err
+		}
+		hash = !hash
+	}
+}
+
+// Recover rebuilds the descriptors of every file in hash storage by
+// scanning the keyspace, on every node in cluster mode. Each descriptor
+// has a single location, for this driver. Files in string storage carry no
+// descriptor, and are skipped. Only keys under the prefix of the key namer
+// are scanned, if it has one, and the file content isn't read.
+func (self *FSRedis) Recover() ([]FileStoreDescriptor, error) {
+	match := "*"
+	if p, ok := self.Namer.(KeyPrefixer); ok {
+		match = redisGlobEscape(p.KeyPrefix()) + "*"
+	}
+
+	pools := make([]*redisPool, 0)
+	if self.cluster != nil {
+		pools = self.cluster.nodes()
+	} else {
+		self.lock.RLock()
+		pools = append(pools, self.rwPool)
+		self.lock.RUnlock()
+	}
+
+	out := make([]FileStoreDescriptor, 0)
+	for _, p := range pools {
+		err := p.do(func(conn redisClient) error {
+			cursor := "0"
+			for {
+				next, keys, err := conn.Scan(cursor, match)
+				if err != nil {
+					return err
+				}
+				for _, k := range keys {
+					if strings.HasPrefix(k, trashPrefix) {
+						continue
+					}
+					fields, err := conn.Hkeys(k)
+					if err != nil {
+						if strings.HasPrefix(err.Error(), "WRONGTYPE") {
+							continue
+						}
+						return err
+					}
+					// Skip the content, and hashes which aren't file data
+					// or were removed since the scan
+					content := false
+					for i := 0; i < len(fields); i++ {
+						if fields[i] == "content" {
+							content = true
+							fields = append(fields[:i], fields[i+1:]...)
+							i--
+						}
+					}
+					if !content {
+						continue
+					}
+					f, err := conn.Hmget(k, fields...)
+					if err != nil {
+						return err
+					}
+					d := redisHashDescriptor(f)
+					l := FileStoreLocation{
+						Id:       self.storeId(),
+						Driver:   self.DriverName(),
+						Location: k,
+					}
+					l.Created, _ = time.Parse(time.RFC3339Nano, string(f["stored"]))
+					d.Location = []FileStoreLocation{l}
+					out = append(out, d)
+				}
+				if next == "0" {
+					return nil
+				}
+				cursor = next
+			}
+		})
+		if err != nil {
+			return out, err
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Id < out[j].Id })
+	return out, nil
+}
+
+// redisGlobEscape escapes the characters special to SCAN MATCH patterns.
+func redisGlobEscape(s string) string {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			b = append(b, '\\')
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
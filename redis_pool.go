@@ -0,0 +1,165 @@
+package fsabstract
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRedisPoolSize is the default maximum number of clients held
+	// open to each Redis server.
+	DefaultRedisPoolSize = 10
+	// DefaultRedisIdleTimeout is the default period after which an unused
+	// pooled client is closed.
+	DefaultRedisIdleTimeout = 5 * time.Minute
+	// DefaultRedisHealthCheck is the default period a pooled client may sit
+	// unused before it is checked with PING ahead of being reused.
+	DefaultRedisHealthCheck = time.Minute
+)
+
+var (
+	errRedisPoolClosed  = errors.New("Redis pool closed")
+	errRedisPoolAborted = errors.New("Redis command aborted")
+)
+
+// redisPool is a bounded pool of persistent clients to a single Redis
+// server. Clients are created on demand, up to size; once that many are in
+// use, callers block until one is returned.
+type redisPool struct {
+	dial        func() (redisClient, error)
+	idleTimeout time.Duration
+	healthCheck time.Duration
+
+	slots  chan bool
+	lock   sync.Mutex
+	idle   []*redisPooledClient // oldest first
+	closed bool
+}
+
+type redisPooledClient struct {
+	redisClient
+	lastUsed time.Time
+}
+
+func newRedisPool(dial func() (redisClient, error), size int, idleTimeout, healthCheck time.Duration) *redisPool {
+	if size < 1 {
+		size = 1
+	}
+	return &redisPool{
+		dial:        dial,
+		idleTimeout: idleTimeout,
+		healthCheck: healthCheck,
+		slots:       make(chan bool, size),
+		idle:        make([]*redisPooledClient, 0, size),
+	}
+}
+
+// get borrows a client from the pool, dialing a new one if no healthy idle
+// client is available. It must be returned with put.
+func (self *redisPool) get() (*redisPooledClient, error) {
+	self.slots <- true
+
+	for {
+		self.lock.Lock()
+		if self.closed {
+			self.lock.Unlock()
+			<-self.slots
+			return nil, errRedisPoolClosed
+		}
+		if len(self.idle) == 0 {
+			self.lock.Unlock()
+			break
+		}
+		// Most recently used first, since it is the most likely to be alive
+		c := self.idle[len(self.idle)-1]
+		self.idle = self.idle[:len(self.idle)-1]
+		self.lock.Unlock()
+
+		unused := time.Since(c.lastUsed)
+		if self.idleTimeout > 0 && unused > self.idleTimeout {
+			c.Quit()
+			continue
+		}
+		if self.healthCheck > 0 && unused > self.healthCheck {
+			if err := c.Ping(); err != nil {
+				c.Quit()
+				continue
+			}
+		}
+		return c, nil
+	}
+
+	conn, err := self.dial()
+	if err != nil {
+		<-self.slots
+		return nil, err
+	}
+	return &redisPooledClient{redisClient: conn}, nil
+}
+
+// put returns a borrowed client to the pool. Clients which saw a network or
+// protocol error are closed rather than reused, since the connection may be
+// in a bad state; error replies from the server, such as WRONGTYPE or MOVED,
+// leave it usable.
+func (self *redisPool) put(c *redisPooledClient, err error) {
+	defer func() { <-self.slots }()
+
+	if _, reply := err.(respError); err != nil && !reply {
+		c.Quit()
+		return
+	}
+
+	now := time.Now()
+	c.lastUsed = now
+
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		c.Quit()
+		return
+	}
+	// Prune clients which have been idle for too long
+	stale := make([]*redisPooledClient, 0)
+	for len(self.idle) > 0 && self.idleTimeout > 0 && now.Sub(self.idle[0].lastUsed) > self.idleTimeout {
+		stale = append(stale, self.idle[0])
+		self.idle = self.idle[1:]
+	}
+	self.idle = append(self.idle, c)
+	self.lock.Unlock()
+
+	for _, v := range stale {
+		v.Quit()
+	}
+}
+
+// do runs fn with a client borrowed from the pool. If fn panics, the client
+// is closed, since it may be part way through a reply, and its slot freed.
+func (self *redisPool) do(fn func(redisClient) error) error {
+	c, err := self.get()
+	if err != nil {
+		return err
+	}
+	err = errRedisPoolAborted
+	defer func() { self.put(c, err) }()
+	err = fn(c.redisClient)
+	return err
+}
+
+// close closes all idle clients, and causes clients still in use to be
+// closed as they are returned.
+func (self *redisPool) close() error {
+	self.lock.Lock()
+	idle := self.idle
+	self.idle = nil
+	self.closed = true
+	self.lock.Unlock()
+
+	var err error
+	for _, c := range idle {
+		if qerr := c.Quit(); qerr != nil && err == nil {
+			err = qerr
+		}
+	}
+	return err
+}
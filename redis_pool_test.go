@@ -0,0 +1,111 @@
+package fsabstract
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRedisClient only implements the commands used by the pool itself.
+type fakeRedisClient struct {
+	redisClient
+	quit bool
+}
+
+func (self *fakeRedisClient) Ping() error {
+	return nil
+}
+
+func (self *fakeRedisClient) Quit() error {
+	self.quit = true
+	return nil
+}
+
+func TestRedisPool(t *testing.T) {
+	dialed := make([]*fakeRedisClient, 0)
+	p := newRedisPool(func() (redisClient, error) {
+		c := new(fakeRedisClient)
+		dialed = append(dialed, c)
+		return c, nil
+	}, 1, time.Minute, time.Minute)
+
+	t.Log("Exhaustion")
+	release := make(chan bool)
+	started := make(chan bool)
+	go p.do(func(redisClient) error {
+		started <- true
+		<-release
+		return nil
+	})
+	<-started
+	done := make(chan bool)
+	go func() {
+		p.do(func(redisClient) error { return nil })
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Fatal("Exhausted pool handed out a client")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- true
+	<-done
+	if len(dialed) != 1 {
+		t.Errorf("Dialed %d clients, expected the first to be reused", len(dialed))
+	}
+
+	t.Log("Failed commands close their client")
+	failed := errors.New("failed")
+	if err := p.do(func(redisClient) error { return failed }); err != failed {
+		t.Errorf("do returned %v", err)
+	}
+	if !dialed[0].quit {
+		t.Error("Client not closed after an error")
+	}
+
+	t.Log("Error replies keep their client")
+	wrongType := respError("WRONGTYPE Operation against a key holding the wrong kind of value")
+	if err := p.do(func(redisClient) error { return wrongType }); err != wrongType {
+		t.Errorf("do returned %v", err)
+	}
+	if dialed[1].quit {
+		t.Error("Client closed after an error reply")
+	}
+	p.do(func(redisClient) error { return nil })
+	if len(dialed) != 2 {
+		t.Errorf("Dialed %d clients, expected the client to be reused after an error reply", len(dialed))
+	}
+
+	t.Log("A panic releases the slot")
+	func() {
+		defer func() { recover() }()
+		p.do(func(redisClient) error { panic("boom") })
+	}()
+	if !dialed[1].quit {
+		t.Error("Client not closed after a panic")
+	}
+	go func() {
+		p.do(func(redisClient) error { return nil })
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Slot leaked by a panic")
+	}
+}
+
+func TestRespErrorReplies(t *testing.T) {
+	// An error within an array, as from EXEC, leaves the stream in step
+	r := bufio.NewReader(strings.NewReader("*2\r\n-ERR failed\r\n:1\r\n+OK\r\n"))
+	v, err := respRead(r)
+	a, _ := v.([]interface{})
+	if err != nil || len(a) != 2 || a[0] != respError("ERR failed") || a[1] != int64(1) {
+		t.Fatalf("respRead returned %v, %v", v, err)
+	}
+	if v, err = respRead(r); v != "OK" || err != nil {
+		t.Errorf("Next reply was %v, %v", v, err)
+	}
+}
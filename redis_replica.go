@@ -0,0 +1,132 @@
+package fsabstract
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultRedisReplicaRetry is the default period a failing replica is
+	// kept out of rotation before it is tried again.
+	DefaultRedisReplicaRetry = 30 * time.Second
+	// DefaultRedisReplicaMaxFailures is the default number of consecutive
+	// failures after which a replica is taken out of rotation.
+	DefaultRedisReplicaMaxFailures = 3
+)
+
+var (
+	// RedisReplicaSelectorMap maps strategy names, as used by the
+	// fs.redis.slaveStrategy configuration key, to replica selectors.
+	RedisReplicaSelectorMap = map[string]func() RedisReplicaSelector{
+		"roundrobin": func() RedisReplicaSelector {
+			return new(RedisRoundRobinSelector)
+		},
+		"random": func() RedisReplicaSelector {
+			return new(RedisRandomSelector)
+		},
+		"leastoutstanding": func() RedisReplicaSelector {
+			return new(RedisLeastOutstandingSelector)
+		},
+	}
+)
+
+// RedisReplicaSelector chooses which of the currently healthy replicas
+// should service a read. It is never called with an empty list, and must be
+// safe for concurrent use.
+type RedisReplicaSelector interface {
+	Select([]*RedisReplica) *RedisReplica
+}
+
+func GetRedisReplicaSelector(strategy string) RedisReplicaSelector {
+	s := strings.TrimSpace(strategy)
+	if _, exists := RedisReplicaSelectorMap[s]; exists {
+		return RedisReplicaSelectorMap[s]()
+	} else {
+		fmt.Println("Unable to resolve redis replica selector " + s)
+		return nil
+	}
+}
+
+// RedisReplica tracks a read-only Redis server, along with its health and
+// the number of requests currently outstanding against it.
+type RedisReplica struct {
+	Server string
+
+	pool        *redisPool
+	outstanding int64
+	retry       time.Duration
+	maxFailures int
+
+	lock      sync.Mutex
+	failures  int
+	downUntil time.Time
+}
+
+// Outstanding returns the number of requests currently in progress.
+func (self *RedisReplica) Outstanding() int64 {
+	return atomic.LoadInt64(&self.outstanding)
+}
+
+// Healthy determines whether the replica is in rotation. Replicas taken
+// out of rotation return to it once their retry period has passed, and
+// are removed again if the next request also fails.
+func (self *RedisReplica) Healthy() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return !self.downUntil.After(time.Now())
+}
+
+func (self *RedisReplica) do(fn func(redisClient) error) error {
+	atomic.AddInt64(&self.outstanding, 1)
+	defer atomic.AddInt64(&self.outstanding, -1)
+	err := self.pool.do(fn)
+
+	self.lock.Lock()
+	if err != nil {
+		self.failures++
+		if self.failures >= self.maxFailures {
+			self.downUntil = time.Now().Add(self.retry)
+		}
+	} else {
+		self.failures = 0
+		self.downUntil = time.Time{}
+	}
+	self.lock.Unlock()
+
+	return err
+}
+
+// RedisRoundRobinSelector cycles through the healthy replicas in turn.
+type RedisRoundRobinSelector struct {
+	next uint64
+}
+
+func (self *RedisRoundRobinSelector) Select(r []*RedisReplica) *RedisReplica {
+	n := atomic.AddUint64(&self.next, 1)
+	return r[(n-1)%uint64(len(r))]
+}
+
+// RedisRandomSelector picks a healthy replica at random.
+type RedisRandomSelector struct{}
+
+func (self *RedisRandomSelector) Select(r []*RedisReplica) *RedisReplica {
+	return r[rand.Intn(len(r))]
+}
+
+// RedisLeastOutstandingSelector picks the healthy replica with the fewest
+// requests in progress, preferring earlier replicas on a tie.
+type RedisLeastOutstandingSelector struct{}
+
+func (self *RedisLeastOutstandingSelector) Select(r []*RedisReplica) *RedisReplica {
+	best := r[0]
+	for _, v := range r[1:] {
+		if v.Outstanding() < best.Outstanding() {
+			best = v
+		}
+	}
+	return best
+}
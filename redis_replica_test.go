@@ -0,0 +1,86 @@
+package fsabstract
+
+import (
+	miniredis "github.com/alicebob/miniredis/v2"
+	"testing"
+	"time"
+)
+
+func TestRedisReplicaSelectors(t *testing.T) {
+	r := []*RedisReplica{{Server: "a"}, {Server: "b"}, {Server: "c"}}
+
+	t.Log("roundrobin")
+	s := GetRedisReplicaSelector("roundrobin")
+	for i := 0; i < 6; i++ {
+		if v := s.Select(r); v != r[i%3] {
+			t.Errorf("Selection %d was %s, expected %s", i, v.Server, r[i%3].Server)
+		}
+	}
+
+	t.Log("random")
+	s = GetRedisReplicaSelector("random")
+	for i := 0; i < 10; i++ {
+		if v := s.Select(r[1:2]); v != r[1] {
+			t.Errorf("Selected %s from a single replica list", v.Server)
+		}
+	}
+
+	t.Log("leastoutstanding")
+	s = GetRedisReplicaSelector("leastoutstanding")
+	r[0].outstanding = 2
+	r[1].outstanding = 1
+	r[2].outstanding = 1
+	if v := s.Select(r); v != r[1] {
+		t.Errorf("Selected %s, expected b", v.Server)
+	}
+}
+
+func TestRedisReplicaHealth(t *testing.T) {
+	m := miniredis.RunT(t)
+	s := miniredis.RunT(t)
+	d := new(FSRedis)
+	d.Configure(map[string]string{
+		"fs.redis.server":           "redis://" + m.Addr() + "/0",
+		"fs.redis.slaveServers":     "redis://" + s.Addr() + "/0",
+		"fs.redis.slaveMaxFailures": "2",
+		"fs.redis.slaveRetry":       "100ms",
+	})
+	if err := d.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	fsd, err := d.Put(FileStoreDescriptor{Id: 1}, []byte("master"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set(fsd.Location[0].Location, "slave")
+	get := func(expected string) {
+		t.Helper()
+		if c, _, err := d.Get(fsd); err != nil || string(c) != expected {
+			t.Errorf("Get returned %q, %v, expected %q", c, err, expected)
+		}
+	}
+	get("slave")
+
+	// Failing reads fall back to the master, and take the slave out of
+	// rotation after slaveMaxFailures
+	s.SetError("LOADING")
+	get("master")
+	if !d.replicas[0].Healthy() {
+		t.Error("Slave out of rotation after a single failure")
+	}
+	get("master")
+	if d.replicas[0].Healthy() {
+		t.Error("Slave still in rotation after repeated failures")
+	}
+	s.SetError("")
+	get("master")
+
+	// It comes back once the retry period has passed
+	time.Sleep(150 * time.Millisecond)
+	get("slave")
+	if d.replicas[0].Outstanding() != 0 {
+		t.Errorf("%d requests outstanding", d.replicas[0].Outstanding())
+	}
+}
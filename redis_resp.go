@@ -0,0 +1,355 @@
+package fsabstract
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// respClient is a minimal Redis client speaking RESP directly, with support
+// for TLS, ACL usernames, timeouts and administrative commands such as
+// SENTINEL and CLUSTER.
+//
+// Replies are returned as string (simple strings), int64 (integers),
+// []byte or nil (bulk strings) and []interface{} (arrays). Error replies
+// are returned as respError, or held as respError elements within arrays.
+type respClient struct {
+	conn         net.Conn
+	r            *bufio.Reader
+	w            *bufio.Writer
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	// asking prefixes every command with ASKING, for requests redirected
+	// with ASK to a cluster node importing the slot.
+	asking bool
+}
+
+// respError is an error reply from the server, after which the connection
+// can still be used.
+type respError string
+
+func (self respError) Error() string {
+	return string(self)
+}
+
+// respDial connects to the server described by c, authenticating and
+// selecting the db as required.
+func respDial(c redisConnection) (*respClient, error) {
+	dialer := &net.Dialer{Timeout: c.dialTimeout}
+	var conn net.Conn
+	var err error
+	if c.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr(), c.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client := &respClient{
+		conn:         conn,
+		r:            bufio.NewReader(conn),
+		w:            bufio.NewWriter(conn),
+		readTimeout:  c.readTimeout,
+		writeTimeout: c.writeTimeout,
+	}
+	if c.password != "" {
+		if c.username != "" {
+			_, err = client.do("AUTH", c.username, c.password)
+		} else {
+			_, err = client.do("AUTH", c.password)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		_, err = client.do("SELECT", strconv.Itoa(c.db))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// respCommand runs a single command over a short lived connection. Unset
+// timeouts default to redisAdminTimeout.
+func respCommand(c redisConnection, args ...string) (interface{}, error) {
+	if c.dialTimeout == 0 {
+		c.dialTimeout = redisAdminTimeout
+	}
+	if c.readTimeout == 0 {
+		c.readTimeout = redisAdminTimeout
+	}
+	if c.writeTimeout == 0 {
+		c.writeTimeout = redisAdminTimeout
+	}
+	client, err := respDial(c)
+	if err != nil {
+		return nil, err
+	}
+	defer client.conn.Close()
+	return client.do(args...)
+}
+
+func (self *respClient) do(args ...string) (interface{}, error) {
+	if self.writeTimeout > 0 {
+		self.conn.SetWriteDeadline(time.Now().Add(self.writeTimeout))
+	}
+	if self.asking {
+		self.write("ASKING")
+	}
+	self.write(args...)
+	err := self.w.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	if self.readTimeout > 0 {
+		self.conn.SetReadDeadline(time.Now().Add(self.readTimeout))
+	}
+	if self.asking {
+		_, err = respRead(self.r)
+		if _, ok := err.(respError); err != nil && !ok {
+			return nil, err
+		}
+		v, cerr := respRead(self.r)
+		if err == nil {
+			err = cerr
+		}
+		return v, err
+	}
+	return respRead(self.r)
+}
+
+func (self *respClient) write(args ...string) {
+	self.w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		self.w.WriteString("$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n")
+	}
+}
+
+func (self *respClient) Get(key string) ([]byte, error) {
+	v, err := self.do("GET", key)
+	if err != nil {
+		return nil, err
+	}
+	b, _ := v.([]byte)
+	return b, nil
+}
+
+func (self *respClient) Set(key string, value []byte, seconds int64) error {
+	args := []string{"SET", key, string(value)}
+	if seconds > 0 {
+		args = append(args, "EX", strconv.FormatInt(seconds, 10))
+	}
+	_, err := self.do(args...)
+	return err
+}
+
+func (self *respClient) Del(key string) (bool, error) {
+	v, err := self.do("DEL", key)
+	if err != nil {
+		return false, err
+	}
+	n, _ := v.(int64)
+	return n > 0, nil
+}
+
+func (self *respClient) Rename(key, newKey string) error {
+	_, err := self.do("RENAME", key, newKey)
+	return err
+}
+
+func (self *respClient) Expire(key string, seconds int64) (bool, error) {
+	v, err := self.do("EXPIRE", key, strconv.FormatInt(seconds, 10))
+	if err != nil {
+		return false, err
+	}
+	n, _ := v.(int64)
+	return n == 1, nil
+}
+
+func (self *respClient) Incr(key string) (int64, error) {
+	v, err := self.do("INCR", key)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := v.(int64)
+	return n, nil
+}
+
+func (self *respClient) Hget(key, field string) ([]byte, error) {
+	v, err := self.do("HGET", key, field)
+	if err != nil {
+		return nil, err
+	}
+	b, _ := v.([]byte)
+	return b, nil
+}
+
+func (self *respClient) Hkeys(key string) ([]string, error) {
+	v, err := self.do("HKEYS", key)
+	if err != nil {
+		return nil, err
+	}
+	a, _ := v.([]interface{})
+	fields := make([]string, len(a))
+	for i := range a {
+		fields[i] = respString(a[i])
+	}
+	return fields, nil
+}
+
+func (self *respClient) Hmget(key string, fields ...string) (map[string][]byte, error) {
+	v, err := self.do(append([]string{"HMGET", key}, fields...)...)
+	if err != nil {
+		return nil, err
+	}
+	a, _ := v.([]interface{})
+	m := make(map[string][]byte, len(a))
+	for i := range a {
+		if b, ok := a[i].([]byte); ok && i < len(fields) {
+			m[fields[i]] = b
+		}
+	}
+	return m, nil
+}
+
+// Hreplace queues DEL, HSET and EXPIRE in a MULTI block, so readers never
+// see the hash missing or with fields from two versions.
+func (self *respClient) Hreplace(key string, fields map[string][]byte, seconds int64) error {
+	hset := []string{"HSET", key}
+	for k, v := range fields {
+		hset = append(hset, k, string(v))
+	}
+	commands := [][]string{{"DEL", key}, hset}
+	if seconds > 0 {
+		commands = append(commands, []string{"EXPIRE", key, strconv.FormatInt(seconds, 10)})
+	}
+
+	_, err := self.do("MULTI")
+	if err != nil {
+		return err
+	}
+	for _, v := range commands {
+		_, err = self.do(v...)
+		if err != nil {
+			self.do("DISCARD")
+			return err
+		}
+	}
+	v, err := self.do("EXEC")
+	if err != nil {
+		return err
+	}
+	a, _ := v.([]interface{})
+	for _, v := range a {
+		if rerr, ok := v.(respError); ok {
+			return rerr
+		}
+	}
+	return nil
+}
+
+func (self *respClient) Scan(cursor, match string) (string, []string, error) {
+	v, err := self.do("SCAN", cursor, "MATCH", match, "COUNT", "100")
+	if err != nil {
+		return "0", nil, err
+	}
+	a, _ := v.([]interface{})
+	if len(a) != 2 {
+		return "0", nil, errors.New("Unexpected SCAN reply")
+	}
+	l, _ := a[1].([]interface{})
+	keys := make([]string, len(l))
+	for i := range l {
+		keys[i] = respString(l[i])
+	}
+	return respString(a[0]), keys, nil
+}
+
+func (self *respClient) Ping() error {
+	_, err := self.do("PING")
+	return err
+}
+
+func (self *respClient) Quit() error {
+	self.do("QUIT")
+	return self.conn.Close()
+}
+
+func respRead(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("Malformed redis reply : " + line)
+	}
+	payload := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, respError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			a[i], err = respRead(r)
+			if rerr, ok := err.(respError); ok {
+				// Read the rest of the array, so the next reply lines up
+				a[i] = rerr
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	}
+	return nil, errors.New("Unknown redis reply type : " + line)
+}
+
+// respString converts a bulk or simple string reply to a string.
+func respString(v interface{}) string {
+	switch t := v.(type) {
+	case []byte:
+		return string(t)
+	case string:
+		return t
+	case int64:
+		return strconv.FormatInt(t, 10)
+	}
+	return ""
+}
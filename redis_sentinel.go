@@ -0,0 +1,130 @@
+package fsabstract
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// discoverMaster asks each sentinel in turn for the address of the master,
+// returning the first answer.
+func (self *FSRedis) discoverMaster() (string, error) {
+	var lastErr error
+	for _, s := range self.SentinelList {
+		c, err := self.sentinelConnection(s)
+		if err != nil {
+			return "", err
+		}
+		reply, err := respCommand(c, "SENTINEL", "get-master-addr-by-name", self.MasterName)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		a, ok := reply.([]interface{})
+		if !ok || len(a) != 2 {
+			lastErr = errors.New("Sentinel " + s + " does not know master " + self.MasterName)
+			continue
+		}
+		return net.JoinHostPort(respString(a[0]), respString(a[1])), nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("No redis sentinels configured")
+	}
+	return "", lastErr
+}
+
+// discoverReplicas asks each sentinel in turn for the addresses of the
+// replicas of the master which are currently up.
+func (self *FSRedis) discoverReplicas() ([]string, error) {
+	var lastErr error
+	for _, s := range self.SentinelList {
+		c, err := self.sentinelConnection(s)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := respCommand(c, "SENTINEL", "replicas", self.MasterName)
+		if err != nil {
+			// Sentinels before Redis 5 only know "slaves"
+			reply, err = respCommand(c, "SENTINEL", "slaves", self.MasterName)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		list, _ := reply.([]interface{})
+		addrs := make([]string, 0, len(list))
+		for _, v := range list {
+			// Each replica is described by a flat list of field/value pairs
+			fields, _ := v.([]interface{})
+			info := map[string]string{}
+			for i := 0; i+1 < len(fields); i += 2 {
+				info[respString(fields[i])] = respString(fields[i+1])
+			}
+			if strings.Contains(info["flags"], "down") || strings.Contains(info["flags"], "disconnected") {
+				continue
+			}
+			addrs = append(addrs, net.JoinHostPort(info["ip"], info["port"]))
+		}
+		return addrs, nil
+	}
+	return nil, lastErr
+}
+
+// failover checks with the sentinels whether the master has moved and, if
+// so, replaces the master pool. It returns true if the master changed.
+func (self *FSRedis) failover() bool {
+	addr, err := self.discoverMaster()
+	if err != nil {
+		log.Print("Unable to discover redis master " + self.MasterName + " : " + err.Error())
+		return false
+	}
+	rurl := redisUrlWithHost(self.RwServer, addr)
+	pool, err := self.newPool(rurl)
+	if err != nil {
+		log.Print("Unable to use redis master " + addr + " : " + err.Error())
+		return false
+	}
+
+	self.lock.Lock()
+	if rurl == self.master {
+		self.lock.Unlock()
+		return false
+	}
+	old := self.rwPool
+	self.rwPool = pool
+	self.master = rurl
+	self.lock.Unlock()
+
+	log.Print("Redis master " + self.MasterName + " is now " + addr)
+	if old != nil {
+		old.close()
+	}
+	return true
+}
+
+// sentinelConnection describes a sentinel, given either as host:port, which
+// uses SentinelPassword, or as a redis URL.
+func (self *FSRedis) sentinelConnection(s string) (redisConnection, error) {
+	if strings.Contains(s, "://") {
+		c, err := self.parseRedisUrl(s)
+		if err == nil && c.password == "" {
+			c.password = self.SentinelPassword
+		}
+		// Sentinels have no dbs, and refuse SELECT
+		c.db = 0
+		return c, err
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return redisConnection{}, errors.New("Could not parse redis sentinel " + s + " : " + err.Error())
+	}
+	c := redisConnection{host: host, password: self.SentinelPassword}
+	c.port, err = strconv.Atoi(port)
+	if err != nil {
+		return c, errors.New("Could not parse port of redis sentinel " + s)
+	}
+	return c, nil
+}
@@ -0,0 +1,206 @@
+package fsabstract
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultTrashRetention is the period for which soft deleted file data
+	// is kept before it becomes eligible to be purged.
+	DefaultTrashRetention = 7 * 24 * time.Hour
+
+	// trashPrefix is prepended to keys by drivers which store trashed
+	// file data in the same keyspace as live file data.
+	trashPrefix = "trash_"
+)
+
+// FSSoftDelete wraps another FileStoreDriver so that Delete becomes
+// recoverable. Deleted file data is moved to the trash namespace of the
+// wrapped driver (if it implements FileStoreTrasher), and the location is
+// kept in the descriptor, marked as deleted, until it is purged after the
+// retention period has passed.
+type FSSoftDelete struct {
+	Driver    FileStoreDriver
+	Retention time.Duration `fsdconfig:"fs.trash.retention"`
+}
+
+// NewSoftDelete wraps a FileStoreDriver with soft delete support, using
+// the default retention period.
+func NewSoftDelete(d FileStoreDriver) *FSSoftDelete {
+	return &FSSoftDelete{
+		Driver:    d,
+		Retention: DefaultTrashRetention,
+	}
+}
+
+// DriverName returns the name of the wrapped driver, so that locations
+// created through the wrapper remain usable with the bare driver.
+func (self *FSSoftDelete) DriverName() string {
+	return self.Driver.DriverName()
+}
+
+func (self *FSSoftDelete) Configure(c map[string]string) {
+	if v, exists := c["fs.trash.retention"]; exists {
+		r, err := time.ParseDuration(v)
+		if err != nil {
+			panic("Unable to parse trash retention " + v)
+		}
+		self.Retention = r
+	}
+	self.Driver.Configure(c)
+}
+
+func (self *FSSoftDelete) Initialize() error {
+	return self.Driver.Initialize()
+}
+
+func (self *FSSoftDelete) Get(d FileStoreDescriptor) ([]byte, FileStoreLocation, error) {
+	return self.Driver.Get(d)
+}
+
+// GetFrom retrieves the file data at a specific location through the
+// wrapped driver.
+func (self *FSSoftDelete) GetFrom(d FileStoreDescriptor, l FileStoreLocation) ([]byte, error) {
+	return GetFrom(self.Driver, d, l)
+}
+
+func (self *FSSoftDelete) Put(d FileStoreDescriptor, c []byte) (FileStoreDescriptor, error) {
+	return self.Driver.Put(d, c)
+}
+
+// PutReader streams file data to the wrapped driver, if it supports it.
+func (self *FSSoftDelete) PutReader(d FileStoreDescriptor, r io.Reader) (FileStoreDescriptor, error) {
+	return PutReader(self.Driver, d, r)
+}
+
+// Delete moves the file data into the trash and marks the location as
+// deleted. Nothing is permanently removed until Purge is called. A location
+// stored by another driver is refused with ErrInvalidLocation.
+func (self *FSSoftDelete) Delete(d FileStoreDescriptor, l FileStoreLocation) (FileStoreDescriptor, error) {
+	dU := d
+
+	// Find the pertinent FileStoreLocation, if we weren't given one
+	if l.Driver == "" && l.Location == "" {
+		var err error
+		l, err = LocationForDriver(d, self.DriverName())
+		if err != nil {
+			return dU, err
+		}
+	} else if l.Driver != self.DriverName() {
+		return dU, ErrInvalidLocation
+	}
+	if l.IsDeleted() {
+		return dU, errors.New("Location already deleted : " + l.ToString())
+	}
+
+	// Move to trash, if the driver supports it
+	tl := l
+	if t, ok := self.Driver.(FileStoreTrasher); ok {
+		var err error
+		tl, err = t.Trash(l)
+		if err != nil {
+			return dU, err
+		}
+	}
+	tl.Deleted = time.Now()
+
+	// Mark location as deleted
+	dU = ReplaceLocation(dU, l, tl)
+
+	// No errors, send back
+	return dU, nil
+}
+
+// Undelete restores a soft deleted location, provided that it has not
+// yet been purged.
+func (self *FSSoftDelete) Undelete(d FileStoreDescriptor, l FileStoreLocation) (FileStoreDescriptor, error) {
+	dU := d
+
+	if !l.IsDeleted() {
+		return dU, errors.New("Location not deleted : " + l.ToString())
+	}
+
+	// Move out of trash, if the driver supports it
+	rl := l
+	if t, ok := self.Driver.(FileStoreTrasher); ok {
+		var err error
+		rl, err = t.Restore(l)
+		if err != nil {
+			return dU, err
+		}
+	}
+	rl.Deleted = time.Time{}
+
+	// Mark location as live
+	dU = ReplaceLocation(dU, l, rl)
+
+	// No errors, send back
+	return dU, nil
+}
+
+// Purge permanently removes any locations for this driver which were soft
+// deleted longer than the retention period ago. Locations which could not
+// be purged are kept in the returned descriptor, along with the first
+// error encountered.
+func (self *FSSoftDelete) Purge(d FileStoreDescriptor) (FileStoreDescriptor, error) {
+	dU := d
+
+	var perr error
+	cutoff := time.Now().Add(-self.Retention)
+	nl := make([]FileStoreLocation, 0, len(d.Location))
+	for _, v := range d.Location {
+		if v.Driver != self.DriverName() || !v.IsDeleted() || v.Deleted.After(cutoff) {
+			nl = append(nl, v)
+			continue
+		}
+
+		var err error
+		if t, ok := self.Driver.(FileStoreTrasher); ok {
+			err = t.Purge(v)
+		} else {
+			_, err = self.Driver.Delete(d, v)
+		}
+		if err != nil {
+			if perr == nil {
+				perr = err
+			}
+			nl = append(nl, v)
+		}
+	}
+	dU.Location = nl
+
+	return dU, perr
+}
+
+// StartPurge runs Purge every interval against the descriptors supplied by
+// source, handing any descriptor which changed to sink so that it can be
+// persisted, ie: with SaveDescriptor, which drops descriptors with nothing
+// left. Closing the returned channel stops the purge job.
+func (self *FSSoftDelete) StartPurge(interval time.Duration, source func() []FileStoreDescriptor, sink func(FileStoreDescriptor)) chan bool {
+	stop := make(chan bool)
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				for _, d := range source() {
+					dU, err := self.Purge(d)
+					if err != nil {
+						log.Print("Purge failed for " + strconv.FormatInt(d.Id, 10) + " : " + err.Error())
+					}
+					if len(dU.Location) != len(d.Location) {
+						sink(dU)
+					}
+				}
+			}
+		}
+	}()
+	return stop
+}
@@ -0,0 +1,106 @@
+package fsabstract
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSoftDelete(t *testing.T) {
+	t.Log("Testing soft delete wrapper")
+
+	basepath, err := ioutil.TempDir("", "fsabstract-trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basepath)
+
+	d := NewSoftDelete(GetDriver("dummy"))
+	d.Configure(map[string]string{
+		"fs.dummy.basepath":  basepath,
+		"fs.trash.retention": "1h",
+	})
+	err = d.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsd := FileStoreDescriptor{
+		Id:      1,
+		Name:    "testfile.bin",
+		Size:    4,
+		Created: time.Now(),
+	}
+	fsd, err = d.Put(fsd, []byte{0xde, 0xad, 0xbe, 0xef})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("Delete()")
+	other := FileStoreLocation{Driver: "other", Location: fsd.Location[0].Location}
+	if _, err = d.Delete(fsd, other); err != ErrInvalidLocation {
+		t.Errorf("Delete() of another driver's location returned %v", err)
+	}
+	fsd, err = d.Delete(fsd, FileStoreLocation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fsd.Location) != 1 || !fsd.Location[0].IsDeleted() {
+		t.Fatal("Location not marked as deleted : " + fsd.ToString())
+	}
+	if _, _, err = d.Get(fsd); err == nil {
+		t.Error("Get() succeeded for deleted file")
+	}
+
+	t.Log("Purge() within retention")
+	fsd, err = d.Purge(fsd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fsd.Location) != 1 {
+		t.Fatal("Location purged within retention period : " + fsd.ToString())
+	}
+
+	t.Log("Undelete()")
+	fsd, err = d.Undelete(fsd, fsd.Location[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := d.Get(fsd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 4 {
+		t.Errorf("len(data) == %d after undelete", len(data))
+	}
+
+	t.Log("Purge() after retention")
+	fsd, err = d.Delete(fsd, FileStoreLocation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trashed := d.Driver.(*FSDummy).fullPath(fsd.Location[0].Location)
+	d.Retention = 0
+	fsd, err = d.Purge(fsd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fsd.Location) != 0 {
+		t.Error("Location not purged : " + fsd.ToString())
+	}
+	if _, err = os.Stat(trashed); !os.IsNotExist(err) {
+		t.Error("Trashed file not removed : " + trashed)
+	}
+
+	// Nothing is left to catalog
+	c := new(DSMemory)
+	c.Initialize()
+	c.Save(fsd)
+	if err = SaveDescriptor(c, fsd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Load(fsd.Id); err != ErrNotFound {
+		t.Errorf("Purged descriptor kept in catalog : %v", err)
+	}
+}
@@ -1,33 +1,276 @@
 package fsabstract
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // LocationForDriver returns the first FileStoreLocation which is represented
-// by the provided FileStoreDescriptor for the specified driver.
+// by the provided FileStoreDescriptor for the specified driver. Soft deleted
+// locations are skipped.
 func LocationForDriver(desc FileStoreDescriptor, driver string) (FileStoreLocation, error) {
 	if desc.Location == nil {
 		return FileStoreLocation{}, errors.New("No locations : " + desc.ToString())
 	}
+	if l := LocationsForDriver(desc, driver); len(l) > 0 {
+		return l[0], nil
+	}
+	return FileStoreLocation{}, errors.New("Driver " + driver + " not found : " + desc.ToString())
+}
+
+// LocationsForDriver returns every FileStoreLocation represented by the
+// provided FileStoreDescriptor for the specified driver, such as copies in
+// several S3 buckets. Soft deleted locations are skipped.
+func LocationsForDriver(desc FileStoreDescriptor, driver string) []FileStoreLocation {
+	l := make([]FileStoreLocation, 0)
 	for _, v := range desc.Location {
-		if v.Driver == driver {
-			return v, nil
+		if v.Driver == driver && !v.IsDeleted() {
+			l = append(l, v)
 		}
 	}
-	return FileStoreLocation{}, errors.New("Driver " + driver + " not found : " + desc.ToString())
+	return l
+}
+
+// LocationsForStore returns every FileStoreLocation represented by the
+// provided FileStoreDescriptor for the specified driver and store Id, such
+// as an S3 bucket name. Soft deleted locations are skipped.
+func LocationsForStore(desc FileStoreDescriptor, driver, id string) []FileStoreLocation {
+	l := make([]FileStoreLocation, 0)
+	for _, v := range LocationsForDriver(desc, driver) {
+		if v.Id == id {
+			l = append(l, v)
+		}
+	}
+	return l
 }
 
-// RemoveLocation removes a FileStoreLocation object from the list stored in
-// a FileStoreDescriptor object. This is a convenience method, necessary
-// because go doesn't have a built-in delete functionality for arrays, just
-// maps.
-func RemoveLocation(d FileStoreDescriptor, l FileStoreLocation) {
-	nl := make([]FileStoreLocation, 0)
+// driverLocation returns the location a driver should act on: l if one
+// was given, or else the first live location for the driver.
+func driverLocation(d FileStoreDescriptor, l FileStoreLocation, driver string) (FileStoreLocation, error) {
+	if l.Driver == "" && l.Location == "" {
+		return LocationForDriver(d, driver)
+	}
+	return l, checkLocation(l, driver)
+}
+
+// checkLocation makes sure that a location was stored by a driver.
+func checkLocation(l FileStoreLocation, driver string) error {
+	if l.Driver != driver {
+		return errors.New("Location not stored by driver " + driver + " : " + l.ToString())
+	}
+	return nil
+}
+
+// AddLocation returns a copy of a FileStoreDescriptor with a
+// FileStoreLocation appended to its list, replacing any location with the
+// same key.
+func AddLocation(d FileStoreDescriptor, l FileStoreLocation) FileStoreDescriptor {
+	d = RemoveLocation(d, l)
+	d.Location = append(d.Location, l)
+	return d
+}
+
+// RemoveLocation returns a copy of a FileStoreDescriptor without any
+// FileStoreLocation having the same key as l. This is a convenience method,
+// necessary because go doesn't have a built-in delete functionality for
+// arrays, just maps.
+func RemoveLocation(d FileStoreDescriptor, l FileStoreLocation) FileStoreDescriptor {
+	nl := make([]FileStoreLocation, 0, len(d.Location)+1)
 	for _, v := range d.Location {
-		if v != l {
+		if v.Key() != l.Key() {
 			nl = append(nl, v)
 		}
 	}
 	d.Location = nl
+	return d
+}
+
+// ReplaceLocation returns a copy of a FileStoreDescriptor in which any
+// FileStoreLocation having the same key as o is swapped for n.
+func ReplaceLocation(d FileStoreDescriptor, o, n FileStoreLocation) FileStoreDescriptor {
+	nl := make([]FileStoreLocation, 0, len(d.Location))
+	for _, v := range d.Location {
+		if v.Key() == o.Key() {
+			nl = append(nl, n)
+		} else {
+			nl = append(nl, v)
+		}
+	}
+	d.Location = nl
+	return d
+}
+
+// expirySeconds returns the number of whole seconds remaining until an
+// expiry time, for backends with relative TTLs. It never returns less than
+// one second, since zero or negative values usually mean "no expiry".
+func expirySeconds(t time.Time) int64 {
+	s := int64(t.Sub(time.Now()) / time.Second)
+	if s < 1 {
+		return 1
+	}
+	return s
+}
+
+// splitList splits a comma separated configuration value, trimming any
+// surrounding whitespace from each entry.
+func splitList(v string) []string {
+	if v == "" {
+		return nil
+	}
+	l := strings.Split(v, ",")
+	for k := range l {
+		l[k] = strings.TrimSpace(l[k])
+	}
+	return l
+}
+
+// parseSize parses a size in bytes, with an optional K, M, G or T suffix
+// (powers of 1024), ie: 512M.
+func parseSize(v string) (int64, error) {
+	t := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(v)), "B")
+	m := int64(1)
+	if i := strings.IndexAny(t, "KMGT"); i >= 0 && i == len(t)-1 {
+		m = int64(1) << (10 * uint(strings.IndexByte("KMGT", t[i])+1))
+		t = t[:i]
+	}
+	n, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("Unable to parse size " + v)
+	}
+	return n * m, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	N int64
+}
+
+func (self *countingReader) Read(p []byte) (int, error) {
+	n, err := self.Reader.Read(p)
+	self.N += int64(n)
+	return n, err
+}
+
+// writeFileAtomic stores the data read from r at path, so that the file
+// either holds all of it or is left as it was, even across a crash. The
+// data is written to a temporary file in the same directory, which is
+// synced and renamed into place before the directory itself is synced.
+// Missing directories are created with dirMode. If prepare is set, it is
+// handed the temporary file before anything is written, and returns the
+// writer to copy the data through. It returns the number of bytes written.
+func writeFileAtomic(path string, r io.Reader, fileMode, dirMode os.FileMode, prepare func(*os.File) (io.Writer, error)) (int64, error) {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, dirMode)
+	if err != nil {
+		return 0, err
+	}
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	var w io.Writer = f
+	if prepare != nil {
+		w, err = prepare(f)
+	}
+	var n int64
+	if err == nil {
+		n, err = io.Copy(w, r)
+	}
+	if err == nil {
+		err = f.Chmod(fileMode)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return n, err
+	}
+	return n, syncDir(dir)
+}
+
+// syncDir flushes a directory, so that renames within it are durable.
+// Windows can't sync directories, and doesn't need to.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// shardPath returns the directories, each ending in a slash, in which a
+// file is placed when files are spread across depth levels of
+// subdirectories, named by successive bytes of a hash of its name.
+func shardPath(name string, depth int) string {
+	p := ""
+	sum := sha256.Sum256([]byte(name))
+	for i := 0; i < depth && i < len(sum); i++ {
+		p += hex.EncodeToString(sum[i:i+1]) + "/"
+	}
+	return p
+}
+
+// containedPath checks that a path lies inside root, once any symlinks in
+// the part of it which exists have been followed. realRoot is root with
+// its own symlinks resolved.
+func containedPath(root, realRoot, p string) error {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return err
+	}
+	if !pathWithin(root, abs) {
+		return ErrInvalidLocation
+	}
+
+	// Find the deepest existing ancestor, and where it really is
+	real := abs
+	for {
+		r, err := filepath.EvalSymlinks(real)
+		if err == nil {
+			real = r
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(real)
+		if parent == real {
+			return ErrInvalidLocation
+		}
+		real = parent
+	}
+	if !pathWithin(realRoot, real) {
+		return ErrInvalidLocation
+	}
+	return nil
+}
+
+// pathWithin determines whether path p is root or lies below it.
+func pathWithin(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
 }
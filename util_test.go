@@ -0,0 +1,88 @@
+package fsabstract
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestLocationHelpers(t *testing.T) {
+	a := FileStoreLocation{Driver: "dummy", Location: "file_1", Created: time.Now()}
+	b := FileStoreLocation{Driver: "s3", Id: "bucket", Location: "fs_1"}
+	d := FileStoreDescriptor{Id: 1, Location: make([]FileStoreLocation, 1, 4)}
+	d.Location[0] = b
+
+	dU := AddLocation(d, a)
+	if len(dU.Location) != 2 || len(d.Location) != 1 {
+		t.Fatalf("AddLocation gave %d locations, original has %d", len(dU.Location), len(d.Location))
+	}
+	// The original's spare capacity isn't written to
+	if d.Location[:2][1].Driver != "" {
+		t.Error("AddLocation modified the original descriptor")
+	}
+	if dU = AddLocation(dU, a); len(dU.Location) != 2 {
+		t.Errorf("Adding a location twice gave %d locations", len(dU.Location))
+	}
+
+	// Locations match by key, whatever their timestamps
+	var c FileStoreLocation
+	j, _ := json.Marshal(a)
+	json.Unmarshal(j, &c)
+	c.Created = c.Created.In(time.FixedZone("other", 3600))
+	if r := RemoveLocation(dU, c); len(r.Location) != 1 || r.Location[0].Driver != "s3" || len(dU.Location) != 2 {
+		t.Errorf("RemoveLocation left %v", r.Location)
+	}
+
+	if l := LocationsForStore(dU, "s3", "bucket"); len(l) != 1 || l[0].Location != "fs_1" {
+		t.Errorf("LocationsForStore returned %v", l)
+	}
+	if l := LocationsForDriver(dU, "memcache"); len(l) != 0 {
+		t.Errorf("LocationsForDriver returned %v", l)
+	}
+
+	n := a
+	n.Location = "trash/file_1"
+	n.Deleted = time.Now()
+	r := ReplaceLocation(dU, c, n)
+	if len(r.Location) != 2 || r.Location[1].Location != n.Location || dU.Location[1].Location != a.Location {
+		t.Errorf("ReplaceLocation gave %v", r.Location)
+	}
+}
+
+// testDriverLocations checks that a driver keeps the other locations of a
+// descriptor through Put and Delete, and that Delete removes the location
+// even once it has been through serialization.
+func testDriverLocations(t *testing.T, d FileStoreDriver) {
+	other := FileStoreLocation{Driver: "other", Location: "elsewhere"}
+	fsd := FileStoreDescriptor{Id: 42, Name: "locations.txt", Location: make([]FileStoreLocation, 1, 4)}
+	fsd.Location[0] = other
+
+	dU, err := d.Put(fsd, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dU.Location) != 2 || dU.Location[0].Key() != other.Key() || dU.Location[1].Driver != d.DriverName() {
+		t.Fatalf("Put gave locations %v", dU.Location)
+	}
+	if len(fsd.Location) != 1 || fsd.Location[:2][1].Driver != "" {
+		t.Error("Put modified the original descriptor")
+	}
+
+	// Round trip, as through a catalog, losing monotonic clock readings
+	var loaded FileStoreDescriptor
+	j, _ := json.Marshal(dU)
+	if err = json.Unmarshal(j, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	c, l, err := d.Get(loaded)
+	if err != nil || string(c) != "data" {
+		t.Fatalf("Get returned %q, %v", c, err)
+	}
+	dU, err = d.Delete(loaded, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dU.Location) != 1 || dU.Location[0].Driver != "other" {
+		t.Errorf("Delete left locations %v", dU.Location)
+	}
+}